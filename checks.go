@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ghCheckRun is a GitHub check run describing the steps of a status context.
+type ghCheckRun struct {
+	Name        string        `json:"name,omitempty"`
+	HeadSHA     string        `json:"head_sha,omitempty"`
+	Status      string        `json:"status,omitempty"`
+	Conclusion  string        `json:"conclusion,omitempty"`
+	DetailsURL  string        `json:"details_url,omitempty"`
+	ExternalID  string        `json:"external_id,omitempty"`
+	StartedAt   string        `json:"started_at,omitempty"`
+	CompletedAt string        `json:"completed_at,omitempty"`
+	Output      ghCheckOutput `json:"output"`
+}
+
+// ghCheckOutput is the markdown shown on a check run's page.
+type ghCheckOutput struct {
+	Title   string `json:"title"`
+	Summary string `json:"summary"`
+	Text    string `json:"text,omitempty"`
+}
+
+// gcb2check returns the check run describing the steps of the build reported
+// in the status context, alongside its commit status gh, as of the Unix
+// nanoseconds nowNano. Final check runs are completed with a conclusion.
+func gcb2check(build buildContext, mani manifest, steps map[int]gcbStep, context string, gh ghStatusUpdate, final bool, nowNano int64) ghCheckRun {
+	st := stepsInOrder(contextSteps(mani, steps, context))
+
+	// Count the steps, then tabulate them and quote the logs of those that
+	// failed.
+	var startNano int64
+	var done, queued int
+	worst := gcbStatusDone
+	for _, s := range st {
+		if s.startNano != 0 && (startNano == 0 || s.startNano < startNano) {
+			startNano = s.startNano
+		}
+		if s.status.finished() {
+			done++
+		}
+		if s.status == gcbStatusQueued {
+			queued++
+		}
+		if r, w := conclusionRank(s.status), conclusionRank(worst); r > w || r == w && s.status < worst {
+			worst = s.status
+		}
+	}
+	summary, text := stepTable(build, mani, st, nowNano)
+
+	name := context
+	if name == "" {
+		name = build.Context
+	}
+	run := ghCheckRun{
+		Name:       name,
+		HeadSHA:    build.SHA,
+		Status:     "in_progress",
+		DetailsURL: gh.TargetURL,
+		ExternalID: build.ID,
+		Output: ghCheckOutput{
+			Title:   fmt.Sprintf("%d of %d steps done", done, len(st)),
+			Summary: summary,
+			Text:    text,
+		},
+	}
+	if startNano != 0 {
+		run.StartedAt = time.Unix(0, startNano).UTC().Format(time.RFC3339)
+	}
+	if queued == len(st) {
+		run.Status = "queued"
+	}
+	if gh.State == ghCommitStateError {
+		run.Output.Title = gh.Description
+	}
+	if build.titleTmpl != nil {
+		view := newStatusView(build, mani, steps, context, gh, nowNano)
+		view.Title = run.Output.Title
+		run.Output.Title = render(build.titleTmpl, view, run.Output.Title)
+	}
+	if !final {
+		return run
+	}
+
+	// Conclude the check run from the worst of its steps.
+	run.Status = "completed"
+	run.CompletedAt = time.Unix(0, nowNano).UTC().Format(time.RFC3339)
+	switch {
+	case worst == gcbStatusTimeout:
+		run.Conclusion = "timed_out"
+	case worst.failed():
+		run.Conclusion = "failure"
+	case worst == gcbStatusCancelled, worst == gcbStatusSkipped:
+		run.Conclusion = "cancelled"
+	case worst == gcbStatusAllowed:
+		run.Conclusion = "neutral"
+	default:
+		run.Conclusion = "success"
+	}
+	return run
+}
+
+// conclusionRank ranks how badly the step status s concludes a check run:
+// failures first, then cancelled or skipped steps, then allowed failures.
+func conclusionRank(s gcbStatus) int {
+	switch {
+	case s.failed():
+		return 3
+	case s == gcbStatusCancelled, s == gcbStatusSkipped:
+		return 2
+	case s == gcbStatusAllowed:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// stepsInOrder returns the steps in the order of the build.
+func stepsInOrder(steps map[int]gcbStep) []gcbStep {
+	st := make([]gcbStep, 0, len(steps))
+	for _, s := range steps {
+		st = append(st, s)
+	}
+	sort.Slice(st, func(i, j int) bool {
+		return st[i].num < st[j].num
+	})
+	return st
+}
+
+// stepTable returns a markdown table of the steps st in the build manifest
+// mani as of the Unix nanoseconds nowNano, and the logs of those that failed.
+func stepTable(build buildContext, mani manifest, st []gcbStep, nowNano int64) (table, logs string) {
+	var tb, lb strings.Builder
+	tb.WriteString("| Step | State | Duration | Exit code | Logs |\n")
+	tb.WriteString("| --- | --- | --- | --- | --- |\n")
+	for _, s := range st {
+		if mani.step(s.num).hide && !s.status.failed() {
+			continue
+		}
+
+		state := s.status.String()
+		if s.status == gcbStatusKilled {
+			state += " (" + signalName(s.signal) + ")"
+		}
+		var d string
+		if s.startNano != 0 {
+			e := s.endNano
+			if e == 0 {
+				e = nowNano
+			}
+			d = fmtDuration(time.Duration(e - s.startNano))
+		}
+		var exit string
+		switch {
+		case s.status.failed(), s.status == gcbStatusAllowed, s.status == gcbStatusDone:
+			exit = strconv.Itoa(s.exit)
+		}
+		fmt.Fprintf(&tb, "| %s | %s | %s | %s | [logs](%s) |\n", mdCell(s.id), state, d, exit, stepURL(build, s.num))
+
+		if s.status.failed() && len(s.logs) > 0 {
+			fmt.Fprintf(&lb, "### %s\n\n```\n", s.id)
+			for _, l := range s.logs {
+				lb.WriteString(ansiEscape.ReplaceAllString(strings.TrimRight(l, "\r\n"), ""))
+				lb.WriteString("\n")
+			}
+			lb.WriteString("```\n\n")
+		}
+	}
+	return tb.String(), lb.String()
+}
+
+// mdCell escapes s for a cell of a markdown table.
+func mdCell(s string) string {
+	return strings.ReplaceAll(s, "|", `\|`)
+}
+
+// ghChecks creates and then updates a check run for each status context.
+type ghChecks struct {
+	// ids are the ids of the check runs we've created, by name.
+	ids map[string]int64
+	// tried are the names of the check runs we've tried to create, which
+	// GitHub may have created even if we didn't hear back.
+	tried map[string]bool
+}
+
+// update creates the check run, or updates it if we've created it before.
+func (c *ghChecks) update(build buildContext, run ghCheckRun) error {
+	if c.ids == nil {
+		c.ids = make(map[string]int64)
+		c.tried = make(map[string]bool)
+	}
+	if _, ok := c.ids[run.Name]; !ok && c.tried[run.Name] {
+		// Look for the check run an earlier attempt may have created.
+		id, err := findCheckRun(build, run.Name)
+		if err != nil {
+			return fmt.Errorf("finding github check run: %w", err)
+		}
+		if id != 0 {
+			c.ids[run.Name] = id
+		}
+	}
+	c.tried[run.Name] = true
+
+	method, path, exp := http.MethodPost, "/check-runs", http.StatusCreated
+	if id, ok := c.ids[run.Name]; ok {
+		method, path, exp = http.MethodPatch, "/check-runs/"+strconv.FormatInt(id, 10), http.StatusOK
+		run.HeadSHA = ""
+	}
+	req, err := newGHRepoReq(build, method, path, run)
+	if err != nil {
+		return fmt.Errorf("building github check run request: %w", err)
+	}
+
+	// Send to GitHub, retrying terminal updates for longer.
+	res, err := doGitHub(req, ghDeadline(build, run.Status == "completed"))
+	if err != nil {
+		return fmt.Errorf("updating github check run: %w", err)
+	}
+	defer res.Body.Close()
+
+	// Validate everything went OK, and remember the check run's id.
+	if res.StatusCode != exp {
+		b, _ := httputil.DumpResponse(res, true)
+		return fmt.Errorf("%s response from github:\n%s", res.Status, b)
+	}
+	if method == http.MethodPost {
+		var created struct {
+			ID int64 `json:"id"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&created); err != nil {
+			return fmt.Errorf("decoding github check run: %w", err)
+		}
+		c.ids[run.Name] = created.ID
+	}
+	if _, err := io.Copy(ioutil.Discard, res.Body); err != nil {
+		return fmt.Errorf("discarding github response body: %w", err)
+	}
+	return nil
+}
+
+// findCheckRun returns the id of this build's check run named name on the
+// commit, or 0 if there isn't one.
+func findCheckRun(build buildContext, name string) (int64, error) {
+	var runs struct {
+		CheckRuns []struct {
+			ID         int64  `json:"id"`
+			ExternalID string `json:"external_id"`
+		} `json:"check_runs"`
+	}
+	path := "/commits/" + url.PathEscape(build.SHA) + "/check-runs?check_name=" + url.QueryEscape(name)
+	if err := getGitHubJSON(build, path, &runs); err != nil {
+		return 0, err
+	}
+	for _, r := range runs.CheckRuns {
+		if r.ExternalID == build.ID {
+			return r.ID, nil
+		}
+	}
+	return 0, nil
+}
+
+// printCheck writes the check run to stdout rather than sending it, for
+// replays.
+func printCheck(build buildContext, run ghCheckRun) error {
+	return json.NewEncoder(os.Stdout).Encode(run)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+// gcpClient is the HTTP client for the GCE metadata server and the cloud build
+// API, which gives up rather than hold up the build's first status.
+var gcpClient = &http.Client{Timeout: 10 * time.Second}
+
+// cloudBuild is the subset of the cloud build API's Build resource that we
+// read, alongside its build configuration.
+type cloudBuild struct {
+	manifestConfig
+	ID             string `json:"id"`
+	BuildTriggerID string `json:"buildTriggerId"`
+}
+
+// fetchManifest gets the manifest of the build from the cloud build API,
+// authenticated with a token from the GCE metadata server, expanding the
+// substitutions in it from the build and the environment env.
+func fetchManifest(ctx context.Context, build buildContext, env []string) (manifest, error) {
+	token, err := metadataToken(ctx, build.Metadata)
+	if err != nil {
+		return manifest{}, err
+	}
+
+	// Get the build.
+	uri := build.CloudBuild + "/v1/projects/" + url.PathEscape(build.Project) +
+		"/locations/" + url.PathEscape(build.Region) +
+		"/builds/" + url.PathEscape(build.ID)
+	var b cloudBuild
+	if err := getJSON(ctx, uri, http.Header{"Authorization": {"Bearer " + token}}, &b); err != nil {
+		return manifest{}, fmt.Errorf("getting build from cloud build: %w", err)
+	}
+	if b.BuildTriggerID != "" {
+		log.Printf("Build %s triggered by %s %q.", b.ID, b.BuildTriggerID, b.Substitutions["TRIGGER_NAME"])
+	}
+	mani := newManifest("build "+b.ID, b.manifestConfig, env)
+	mani.triggerID = b.BuildTriggerID
+	return mani, nil
+}
+
+// metadataToken returns an access token for the default service account from
+// the GCE metadata server at host.
+func metadataToken(ctx context.Context, host string) (string, error) {
+	var t struct {
+		AccessToken string `json:"access_token"`
+	}
+	uri := "http://" + host + "/computeMetadata/v1/instance/service-accounts/default/token"
+	if err := getJSON(ctx, uri, http.Header{"Metadata-Flavor": {"Google"}}, &t); err != nil {
+		return "", fmt.Errorf("getting token from metadata server: %w", err)
+	}
+	return t.AccessToken, nil
+}
+
+// getJSON requests uri with the headers h and decodes the response into v.
+func getJSON(ctx context.Context, uri string, h http.Header, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header = h
+	res, err := gcpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := httputil.DumpResponse(res, true)
+		return fmt.Errorf("%s response:\n%s", res.Status, b)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
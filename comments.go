@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ghComment is a comment on a GitHub issue or pull request.
+type ghComment struct {
+	ID   int64  `json:"id,omitempty"`
+	Body string `json:"body"`
+}
+
+// commentMarker returns the hidden markdown marking the pull request comment
+// of the build's status context, so that later builds edit it too.
+func commentMarker(build buildContext) string {
+	return "<!-- gcb2gh:" + build.Context + " -->"
+}
+
+// gcb2comment returns the markdown of the pull request comment describing all
+// of the steps of the build, whose commit state is state, as of the Unix
+// nanoseconds nowNano.
+func gcb2comment(build buildContext, mani manifest, steps map[int]gcbStep, state ghCommitState, nowNano int64) string {
+	var sb strings.Builder
+	sb.WriteString(commentMarker(build))
+	sb.WriteString("\n")
+
+	// Headline the build's state, linking to it.
+	verb := map[ghCommitState]string{
+		ghCommitStatePending: "is running",
+		ghCommitStateSuccess: "passed",
+		ghCommitStateError:   "failed",
+	}[state]
+	fmt.Fprintf(&sb, "**%s** %s", build.Context, verb)
+	if build.Branch != "" {
+		fmt.Fprintf(&sb, " on `%s`", build.Branch)
+	}
+	fmt.Fprintf(&sb, ": [%s](%s)\n\n", build.ID, buildURL(build))
+
+	// Tabulate the steps, and quote the logs of those that failed.
+	table, logs := stepTable(build, mani, stepsInOrder(steps), nowNano)
+	sb.WriteString(table)
+	if logs != "" {
+		sb.WriteString("\n")
+		sb.WriteString(strings.TrimRight(logs, "\n"))
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// buildURL returns the URL of the build in the cloud console.
+func buildURL(build buildContext) string {
+	target := "https://console.cloud.google.com/cloud-build/builds;region=" + build.Region + "/" + url.PathEscape(build.ID)
+	target += "?project=" + url.QueryEscape(build.Project)
+	return target
+}
+
+// ghComments creates and then edits the build's comment on its pull request.
+type ghComments struct {
+	// id is the id of the comment, once we've found or created it.
+	id int64
+}
+
+// update sets the body of the build's comment on the pull request c.PR,
+// looking for one left by an earlier build or attempt before creating it.
+// Final updates are retried for longer.
+func (c *ghComments) update(build buildContext, body string, final bool) error {
+	if c.id == 0 {
+		id, err := findComment(build, commentMarker(build))
+		if err != nil {
+			return fmt.Errorf("finding github pull request comment: %w", err)
+		}
+		c.id = id
+	}
+	method, path, exp := http.MethodPost, "/issues/"+url.PathEscape(build.PR)+"/comments", http.StatusCreated
+	if c.id != 0 {
+		method, path, exp = http.MethodPatch, "/issues/comments/"+strconv.FormatInt(c.id, 10), http.StatusOK
+	}
+	req, err := newGHRepoReq(build, method, path, ghComment{Body: body})
+	if err != nil {
+		return fmt.Errorf("building github comment request: %w", err)
+	}
+
+	// Send to GitHub, retrying terminal updates for longer.
+	res, err := doGitHub(req, ghDeadline(build, final))
+	if err != nil {
+		return fmt.Errorf("updating github pull request comment: %w", err)
+	}
+	defer res.Body.Close()
+
+	// Validate everything went OK, and remember the comment's id.
+	if res.StatusCode != exp {
+		b, _ := httputil.DumpResponse(res, true)
+		return fmt.Errorf("%s response from github:\n%s", res.Status, b)
+	}
+	if method == http.MethodPost {
+		var created ghComment
+		if err := json.NewDecoder(res.Body).Decode(&created); err != nil {
+			return fmt.Errorf("decoding github comment: %w", err)
+		}
+		c.id = created.ID
+	}
+	if _, err := io.Copy(ioutil.Discard, res.Body); err != nil {
+		return fmt.Errorf("discarding github response body: %w", err)
+	}
+	return nil
+}
+
+// findComment returns the id of the first comment on the pull request
+// build.PR containing marker, or 0 if there isn't one.
+func findComment(build buildContext, marker string) (int64, error) {
+	const perPage = 100
+	for page := 1; ; page++ {
+		path := "/issues/" + url.PathEscape(build.PR) + "/comments?per_page=" + strconv.Itoa(perPage) + "&page=" + strconv.Itoa(page)
+		var comments []ghComment
+		if err := getGitHubJSON(build, path, &comments); err != nil {
+			return 0, err
+		}
+
+		for _, c := range comments {
+			if strings.Contains(c.Body, marker) {
+				return c.ID, nil
+			}
+		}
+		if len(comments) < perPage {
+			return 0, nil
+		}
+	}
+}
+
+// printComment writes the pull request comment to stdout rather than sending
+// it, for replays.
+func printComment(build buildContext, body string, final bool) error {
+	return json.NewEncoder(os.Stdout).Encode(ghComment{Body: body})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// contextRoute routes the steps with ids matching a pattern to a status
+// context.
+type contextRoute struct {
+	// glob is the path.Match pattern of step ids, if re is nil.
+	glob string
+	// re is the pattern of step ids given as "/regexp/", or nil.
+	re *regexp.Regexp
+	// context is the status context, or "*" for a context per step. Routes
+	// of deploy steps give their environment instead.
+	context string
+}
+
+// parseContextRoutes parses the comma separated "pattern=context" routes in
+// routes, where pattern is a glob or a "/regexp/" matching step ids.
+func parseContextRoutes(routes string) ([]contextRoute, error) {
+	if routes == "" {
+		return nil, nil
+	}
+	var rs []contextRoute
+	for _, route := range strings.Split(routes, ",") {
+		i := strings.LastIndex(route, "=")
+		if i <= 0 || i == len(route)-1 {
+			return nil, fmt.Errorf(`route %q isn't of the form "pattern=context"`, route)
+		}
+		r := contextRoute{glob: route[:i], context: route[i+1:]}
+		if len(r.glob) > 1 && strings.HasPrefix(r.glob, "/") && strings.HasSuffix(r.glob, "/") {
+			re, err := regexp.Compile(r.glob[1 : len(r.glob)-1])
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %w", route, err)
+			}
+			r.re = re
+		} else if _, err := path.Match(r.glob, ""); err != nil {
+			return nil, fmt.Errorf("route %q: %w", route, err)
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// matches returns whether the route applies to the step id.
+func (r contextRoute) matches(id string) bool {
+	if r.re != nil {
+		return r.re.MatchString(id)
+	}
+	ok, _ := path.Match(r.glob, id)
+	return ok
+}
+
+// routeContexts sets the status context of each step in the manifest m
+// without its own GCB2GH_CONTEXT to that of the first route matching its id.
+// Steps routed to "*" get their own context named after the main context
+// main, and steps routed to main are left in it.
+func routeContexts(m manifest, routes []contextRoute, main string) {
+	for n, ms := range m.steps {
+		c := ms.context
+		for _, r := range routes {
+			if c != "" {
+				break
+			}
+			if r.matches(ms.id) {
+				c = r.context
+			}
+		}
+		if c == "*" {
+			c = main + "/" + ms.id
+		}
+		if c == main {
+			c = ""
+		}
+		m.steps[n].context = c
+	}
+}
+
+// stepContexts returns the status contexts that the steps are reported in,
+// with "" for the main context, in order.
+func stepContexts(mani manifest, steps map[int]gcbStep) []string {
+	seen := make(map[string]bool)
+	var contexts []string
+	for n := range steps {
+		if c := mani.step(n).context; !seen[c] {
+			seen[c] = true
+			contexts = append(contexts, c)
+		}
+	}
+	sort.Strings(contexts)
+	return contexts
+}
+
+// contextSteps returns the steps reported in the status context, or the main
+// one if it's empty.
+func contextSteps(mani manifest, steps map[int]gcbStep, context string) map[int]gcbStep {
+	own := make(map[int]gcbStep, len(steps))
+	for n, s := range steps {
+		if mani.step(n).context == context {
+			own[n] = s
+		}
+	}
+	return own
+}
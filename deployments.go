@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// ghDeployment is a GitHub deployment of the commit being built to an
+// environment.
+type ghDeployment struct {
+	Ref         string `json:"ref"`
+	Task        string `json:"task,omitempty"`
+	Environment string `json:"environment"`
+	Description string `json:"description,omitempty"`
+	// Payload identifies the build that created the deployment.
+	Payload   map[string]string `json:"payload,omitempty"`
+	AutoMerge bool              `json:"auto_merge"`
+	// RequiredContexts is empty, as the build's own statuses are pending.
+	RequiredContexts []string `json:"required_contexts"`
+}
+
+// ghDeploymentStatus is the state of a GitHub deployment.
+type ghDeploymentStatus struct {
+	State       string `json:"state"`
+	LogURL      string `json:"log_url,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// ghDeploy is the desired GitHub state of a deploy step: its deployment to the
+// environment, and the deployment's status.
+type ghDeploy struct {
+	num         int
+	id          string
+	environment string
+	status      ghDeploymentStatus
+}
+
+// deployEnvironment returns the environment that the step id deploys to, from
+// the first of routes matching it, or "" if it doesn't deploy. Steps routed to
+// "*" deploy to an environment named after themselves.
+func deployEnvironment(routes []contextRoute, id string) string {
+	for _, r := range routes {
+		if !r.matches(id) {
+			continue
+		}
+		if r.context == "*" {
+			return id
+		}
+		return r.context
+	}
+	return ""
+}
+
+// gcb2deploy returns the GitHub deployment status of the deploy step s to the
+// environment, and false if the step hasn't started.
+func gcb2deploy(build buildContext, s gcbStep, environment string) (ghDeploy, bool) {
+	var state string
+	switch {
+	case s.status == gcbStatusRunning:
+		state = "in_progress"
+	case s.status == gcbStatusDone:
+		state = "success"
+	case s.status.failed(), s.status == gcbStatusAllowed:
+		state = "failure"
+	case s.status == gcbStatusCancelled:
+		state = "inactive"
+	default:
+		return ghDeploy{}, false
+	}
+	return ghDeploy{
+		num:         s.num,
+		id:          s.id,
+		environment: environment,
+		status: ghDeploymentStatus{
+			State:       state,
+			LogURL:      stepURL(build, s.num),
+			Description: s.id + ": " + s.status.String(),
+		},
+	}, true
+}
+
+// ghDeployments creates a deployment for each deploy step once it starts, and
+// then updates its status.
+type ghDeployments struct {
+	// ids are the ids of the deployments we've created, by step number.
+	ids map[int]int64
+	// tried are the steps we've tried to create deployments for, which
+	// GitHub may have created even if we didn't hear back.
+	tried map[int]bool
+}
+
+// update creates the step's deployment if we haven't before, and sets its
+// status. Final updates are retried for longer.
+func (c *ghDeployments) update(build buildContext, d ghDeploy, final bool) error {
+	if c.ids == nil {
+		c.ids = make(map[int]int64)
+		c.tried = make(map[int]bool)
+	}
+	id, ok := c.ids[d.num]
+	if !ok && c.tried[d.num] {
+		// Look for the deployment an earlier attempt may have created.
+		var err error
+		id, err = findDeployment(build, d)
+		if err != nil {
+			return fmt.Errorf("finding github deployment: %w", err)
+		}
+		ok = id != 0
+	}
+	if !ok {
+		c.tried[d.num] = true
+		var err error
+		id, err = createDeployment(build, ghDeployment{
+			Ref:              build.SHA,
+			Task:             "deploy",
+			Environment:      d.environment,
+			Description:      d.id,
+			Payload:          map[string]string{"build_id": build.ID},
+			RequiredContexts: []string{},
+		}, final)
+		if err != nil {
+			return fmt.Errorf("creating github deployment: %w", err)
+		}
+	}
+	c.ids[d.num] = id
+
+	req, err := newGHRepoReq(build, http.MethodPost, "/deployments/"+strconv.FormatInt(id, 10)+"/statuses", d.status)
+	if err != nil {
+		return fmt.Errorf("building github deployment status request: %w", err)
+	}
+	// Setting the same status twice is harmless.
+	idempotent(req)
+
+	// Send to GitHub, retrying terminal updates for longer.
+	res, err := doGitHub(req, ghDeadline(build, final))
+	if err != nil {
+		return fmt.Errorf("updating github deployment status: %w", err)
+	}
+	defer res.Body.Close()
+
+	// Validate everything went OK.
+	if res.StatusCode != http.StatusCreated {
+		b, _ := httputil.DumpResponse(res, true)
+		return fmt.Errorf("%s response from github:\n%s", res.Status, b)
+	}
+	if _, err := io.Copy(ioutil.Discard, res.Body); err != nil {
+		return fmt.Errorf("discarding github response body: %w", err)
+	}
+	return nil
+}
+
+// createDeployment creates the deployment in GitHub and returns its id.
+func createDeployment(build buildContext, d ghDeployment, final bool) (int64, error) {
+	req, err := newGHRepoReq(build, http.MethodPost, "/deployments", d)
+	if err != nil {
+		return 0, err
+	}
+	res, err := doGitHub(req, ghDeadline(build, final))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		b, _ := httputil.DumpResponse(res, true)
+		return 0, fmt.Errorf("%s response from github:\n%s", res.Status, b)
+	}
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&created); err != nil {
+		return 0, fmt.Errorf("decoding github deployment: %w", err)
+	}
+	return created.ID, nil
+}
+
+// findDeployment returns the id of the deployment of the deploy step d that
+// this build created, or 0 if there isn't one.
+func findDeployment(build buildContext, d ghDeploy) (int64, error) {
+	var deployments []struct {
+		ID          int64             `json:"id"`
+		Description string            `json:"description"`
+		Payload     map[string]string `json:"payload"`
+	}
+	path := "/deployments?sha=" + url.QueryEscape(build.SHA) + "&environment=" + url.QueryEscape(d.environment) + "&task=deploy"
+	if err := getGitHubJSON(build, path, &deployments); err != nil {
+		return 0, err
+	}
+	for _, dep := range deployments {
+		if dep.Description == d.id && dep.Payload["build_id"] == build.ID {
+			return dep.ID, nil
+		}
+	}
+	return 0, nil
+}
+
+// printDeploy writes the deploy step's deployment status to stdout rather
+// than sending it, for replays.
+func printDeploy(build buildContext, d ghDeploy, final bool) error {
+	return json.NewEncoder(os.Stdout).Encode(struct {
+		Environment string `json:"environment"`
+		ghDeploymentStatus
+	}{d.environment, d.status})
+}
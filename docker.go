@@ -0,0 +1,833 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dockerAPIVersion is the newest Docker Engine API version we speak.
+const dockerAPIVersion = "1.43"
+
+// dockerClient makes requests to the Docker Engine API.
+type dockerClient struct {
+	http *http.Client
+	host string
+	// version is the negotiated API version to pin requests to, or empty to
+	// make unversioned requests.
+	version string
+}
+
+// newDockerClient returns a client for the Docker daemon at dockerHost, which
+// may be a unix:// socket, a tcp:// address or an http(s):// URL. As with the
+// docker CLI, TCP connections use TLS if useTLS or tlsVerify is true, only
+// verifying the daemon's certificate if tlsVerify is true, with any ca.pem,
+// cert.pem and key.pem in certPath.
+func newDockerClient(dockerHost, certPath string, useTLS, tlsVerify bool) (*dockerClient, error) {
+	u, err := url.Parse(dockerHost)
+	if err != nil {
+		return nil, fmt.Errorf("parsing docker host: %w", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	switch u.Scheme {
+	case "unix":
+		// Swap out the dialer if we're using a unix socket.
+		path := u.Path
+		dockerHost = "http://docker"
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		return &dockerClient{http: &http.Client{Transport: transport}, host: dockerHost}, nil
+
+	case "tcp":
+		u.Scheme = "http"
+		if useTLS || tlsVerify {
+			u.Scheme = "https"
+		}
+		dockerHost = u.String()
+
+	case "http", "https":
+		// Use as is.
+
+	default:
+		return nil, fmt.Errorf("unsupported docker host %q", dockerHost)
+	}
+
+	// Load the TLS certificates.
+	if u.Scheme == "https" {
+		if certPath == "" {
+			// Without a home, as in a scratch image, there are no
+			// certificates to find.
+			if home, err := os.UserHomeDir(); err == nil {
+				certPath = filepath.Join(home, ".docker")
+			}
+		}
+		transport.TLSClientConfig, err = dockerTLSConfig(certPath, tlsVerify)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &dockerClient{http: &http.Client{Transport: transport}, host: strings.TrimSuffix(dockerHost, "/")}, nil
+}
+
+// dockerTLSConfig returns the TLS client configuration for the docker
+// certificates ca.pem, cert.pem and key.pem in certPath, each of which is
+// optional, as with the docker CLI. The daemon's certificate is only verified
+// if verify is true, against ca.pem if there is one, or else the system's
+// CAs.
+func dockerTLSConfig(certPath string, verify bool) (*tls.Config, error) {
+	c := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: !verify,
+	}
+	if certPath == "" {
+		return c, nil
+	}
+
+	// Trust the CA.
+	caFile := filepath.Join(certPath, "ca.pem")
+	if ca, err := os.ReadFile(caFile); err == nil && verify {
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("reading docker CA certificate: %w", err)
+	}
+
+	// Present our client certificate, if we have one.
+	certFile, keyFile := filepath.Join(certPath, "cert.pem"), filepath.Join(certPath, "key.pem")
+	if _, err := os.Stat(certFile); errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading docker client certificate: %w", err)
+	}
+	c.Certificates = []tls.Certificate{cert}
+	return c, nil
+}
+
+// get requests path from the docker daemon. Responses other than 200 OK are
+// returned as errors with exitDocker.
+func (d *dockerClient) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	uri := d.host + path
+	if d.version != "" {
+		uri = d.host + "/v" + d.version + path
+	}
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := d.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		h, _ := httputil.DumpResponse(res, true)
+		res.Body.Close()
+		return nil, exit(exitDocker, fmt.Errorf("%s response from docker %s:\n%s", res.Status, path, h))
+	}
+	return res, nil
+}
+
+// getJSON requests path from the docker daemon and decodes the response into
+// v.
+func (d *dockerClient) getJSON(ctx context.Context, path string, query url.Values, v interface{}) error {
+	res, err := d.get(ctx, path, query)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// inspect returns the low-level details of the container with the given ID or
+// name.
+func (d *dockerClient) inspect(ctx context.Context, id string) (dockerContainerJSON, error) {
+	var c dockerContainerJSON
+	err := d.getJSON(ctx, "/containers/"+url.PathEscape(id)+"/json", nil, &c)
+	if err != nil {
+		return c, fmt.Errorf("inspecting docker container %s: %w", id, err)
+	}
+	return c, nil
+}
+
+// logs returns the last tail lines of stdout and stderr logged by the
+// container with the given ID.
+func (d *dockerClient) logs(ctx context.Context, id string, tail int) ([]string, error) {
+	if id == "" {
+		return nil, nil
+	}
+	res, err := d.get(ctx, "/containers/"+url.PathEscape(id)+"/logs", url.Values{
+		"stdout": {"1"},
+		"stderr": {"1"},
+		"tail":   {strconv.Itoa(tail)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetching docker container %s logs: %w", id, err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("reading docker container %s logs: %w", id, err)
+	}
+	return demuxLogs(b), nil
+}
+
+// demuxLogs splits the docker log stream b into lines. Unless the container
+// has a TTY, docker multiplexes stdout and stderr into frames, each with an 8
+// byte header of the stream number, 3 zero bytes and the big-endian frame
+// size.
+func demuxLogs(b []byte) []string {
+	var out bytes.Buffer
+	for len(b) >= 8 && b[0] <= 2 && b[1] == 0 && b[2] == 0 && b[3] == 0 {
+		size := int(binary.BigEndian.Uint32(b[4:8]))
+		b = b[8:]
+		if size > len(b) {
+			size = len(b)
+		}
+		out.Write(b[:size])
+		b = b[size:]
+	}
+	out.Write(b)
+
+	text := strings.TrimRight(out.String(), "\n")
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+}
+
+// negotiate pins the client to the newest API version supported by both us and
+// the daemon. The daemon's version comes from the API-Version header of
+// /_ping, or failing that the ApiVersion reported by /version. If neither can
+// be found, requests remain unversioned and get the daemon's default.
+func (d *dockerClient) negotiate(ctx context.Context) error {
+	d.version = ""
+
+	// Ping the daemon.
+	var v string
+	res, err := d.get(ctx, "/_ping", nil)
+	if err == nil {
+		v = res.Header.Get("API-Version")
+		res.Body.Close()
+	}
+
+	// Ask for the version, which older daemons don't return on ping.
+	if v == "" {
+		var ver dockerVersion
+		if err := d.getJSON(ctx, "/version", nil, &ver); err != nil {
+			return fmt.Errorf("requesting docker version: %w", err)
+		}
+		v = ver.APIVersion
+	}
+	if v == "" {
+		return errors.New("docker daemon didn't report its API version")
+	}
+
+	// Use the older of the two.
+	if apiVersionLess(dockerAPIVersion, v) {
+		v = dockerAPIVersion
+	}
+	d.version = v
+	return nil
+}
+
+// apiVersionLess returns whether the docker API version a is older than b.
+func apiVersionLess(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if an, bn := atoi(as[i]), atoi(bs[i]); an != bn {
+			return an < bn
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// dockerSteps lists the step containers known to the docker daemon and returns
+// the current state of each of the steps that has started.
+func dockerSteps(ctx context.Context, docker *dockerClient, f stepFilter) ([]gcbStep, error) {
+	var cs []dockerContainer
+	err := docker.getJSON(ctx, "/containers/json", url.Values{
+		"all":     {"1"},
+		"filters": {f.containerFilters()},
+	}, &cs)
+	if err != nil {
+		return nil, fmt.Errorf("listing docker containers: %w", err)
+	}
+
+	var steps []gcbStep
+	for _, c := range cs {
+		// Filter for step containers.
+		isStep := false
+		for _, name := range c.Names {
+			if _, ok := f.num(strings.TrimPrefix(name, "/")); ok {
+				isStep = true
+			}
+		}
+		if !isStep {
+			continue
+		}
+
+		// Read the container's state.
+		ci, err := docker.inspect(ctx, c.ID)
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := containerStep(ci, f); ok {
+			steps = append(steps, s)
+		}
+	}
+	return steps, nil
+}
+
+// containerStep converts the inspected step container c into the state of its
+// build step, returning false if it isn't a step or hasn't started yet.
+func containerStep(c dockerContainerJSON, f stepFilter) (gcbStep, bool) {
+	name := strings.TrimPrefix(c.Name, "/")
+	num, ok := f.num(name)
+	if !ok || c.State.StartedAt.IsZero() {
+		return gcbStep{}, false
+	}
+
+	s := gcbStep{
+		num:       num,
+		id:        f.id(num, name),
+		container: c.ID,
+		startNano: c.State.StartedAt.UnixNano(),
+	}
+	switch {
+	case c.State.Running:
+		s.status = gcbStatusRunning
+	case c.State.FinishedAt.IsZero():
+		return gcbStep{}, false
+	default:
+		s.endNano = c.State.FinishedAt.UnixNano()
+		s.exit = c.State.ExitCode
+		switch {
+		case s.exit == 0:
+			s.status = gcbStatusDone
+		case c.State.OOMKilled:
+			s.status = gcbStatusOOM
+		default:
+			s.status = gcbStatusError
+		}
+	}
+	return s, true
+}
+
+// dockerUpdates follows the container events on the stream s, sending step
+// updates back on the updates channel. If the event stream drops, we reconnect
+// with backoff and resume from the last event seen. The stream is only
+// considered finished once we've been without a connection to the daemon for
+// longer than reconnect since the last event, which in GCB means the build
+// worker is being torn down, or we've replayed all of the recorded events.
+func dockerUpdates(ctx context.Context, s *dockerStream, reconnect time.Duration, updates chan<- gcbStep, f stepFilter) error {
+	// Replay the recorded events.
+	if s.replay != "" {
+		_, _, err := s.follow(ctx, updates, f)
+		return err
+	}
+
+	// Follow the event stream, reconnecting until the daemon stays away.
+	backoff := 100 * time.Millisecond
+	var lost time.Duration
+	for {
+		start := time.Now()
+		n, up, err := s.follow(ctx, updates, f)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var exitErr *exitError
+		if errors.As(err, &exitErr) {
+			return err
+		}
+
+		// Work out how long we've been without a connection since the last
+		// event, however long the stream was quiet while connected.
+		if n > 0 {
+			lost = 0
+			backoff = 100 * time.Millisecond
+		} else {
+			lost += time.Since(start) - up
+		}
+		if lost > reconnect {
+			if !s.connected {
+				return err
+			}
+			log.Printf("Docker event stream lost for %s: assuming the build is over.", fmtDuration(lost))
+			return nil
+		}
+
+		// Wait before reconnecting.
+		if err == nil {
+			err = io.EOF
+		}
+		log.Printf("Docker event stream ended (%s): reconnecting in %s.", err, backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		lost += backoff
+		if backoff *= 2; backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
+	}
+}
+
+// dockerStream follows the Docker events stream across reconnections,
+// remembering where it got up to.
+type dockerStream struct {
+	// docker is the daemon to follow, or nil if replaying.
+	docker *dockerClient
+	// logTail is the number of log lines to fetch for failed steps.
+	logTail int
+	// record, if set, receives a copy of each event as a recordedEvent.
+	record io.Writer
+	// replay, if set, is a file of recordedEvents to follow instead of the
+	// docker daemon, paced as they were recorded if realtime is set.
+	replay   string
+	realtime bool
+
+	// since is the docker "since" filter for the next connection.
+	since string
+	// lastNano is the timeNano of the last event seen, and lastSeen the
+	// events seen at exactly that time, so that resuming from lastNano
+	// doesn't double count them.
+	lastNano int64
+	lastSeen map[string]bool
+	// connected is set once we've connected to the daemon at least once.
+	connected bool
+	// names caches container names by ID for legacy events that lack them.
+	names map[string]string
+	// ooms are the IDs of containers that have run out of memory.
+	ooms map[string]bool
+	// watches collect the stats of running containers by ID.
+	watches map[string]*statsWatch
+}
+
+// follow streams events from the docker daemon until the stream ends, sending
+// any step updates back on the updates channel. It returns the number of new
+// events received, how long the stream was connected for, and nil if the
+// stream ended cleanly.
+func (s *dockerStream) follow(ctx context.Context, updates chan<- gcbStep, f stepFilter) (n int, up time.Duration, err error) {
+	// Start the docker events stream.
+	events, err := s.open(ctx, f)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer events.Close()
+	s.connected = true
+	connected := time.Now()
+	defer func() { up = time.Since(connected) }()
+
+	// Loop over the events coming back from docker.
+	r := json.NewDecoder(events)
+	var last time.Time
+	for {
+		// Read the next event.
+		var rec recordedEvent
+		var err error
+		if s.replay != "" {
+			err = r.Decode(&rec)
+		} else {
+			err = r.Decode(&rec.Event)
+			rec.Time = time.Now()
+		}
+		switch err {
+		case nil:
+			// Continue.
+		default:
+			return n, 0, fmt.Errorf("decoding event: %w", err)
+		case io.EOF:
+			return n, 0, nil
+		}
+		var e dockerEvent
+		if err := json.Unmarshal(rec.Event, &e); err != nil {
+			return n, 0, fmt.Errorf("decoding event: %w", err)
+		}
+
+		// Record or pace the event.
+		if s.record != nil {
+			if err := json.NewEncoder(s.record).Encode(rec); err != nil {
+				log.Printf("Error recording docker event: %s", err)
+			}
+		}
+		if s.realtime && !last.IsZero() {
+			select {
+			case <-ctx.Done():
+				return n, 0, ctx.Err()
+			case <-time.After(rec.Time.Sub(last)):
+			}
+		}
+		last = rec.Time
+
+		// Skip anything we saw before reconnecting.
+		ce := e.normalise()
+		if !s.advance(ce) {
+			continue
+		}
+		n++
+
+		// Update the build process steps.
+		s.resolve(ctx, &ce)
+		if ce.action == "oom" {
+			if s.ooms == nil {
+				s.ooms = make(map[string]bool)
+			}
+			s.ooms[ce.id] = true
+		}
+		if st, ok := stepUpdate(ce, f); ok {
+			if st.status == gcbStatusError && s.oomKilled(ctx, ce.id) {
+				st.status = gcbStatusOOM
+			}
+			switch {
+			case st.status == gcbStatusRunning:
+				s.watchStats(ctx, ce.id)
+			case st.endNano != 0:
+				// Steps may survive signals, so only stop once it
+				// has exited or been cancelled.
+				st.stats = s.stopStats(ce.id)
+			}
+			if st.status != gcbStatusRunning && st.status != gcbStatusDone && s.logTail > 0 && s.docker != nil {
+				st.logs, err = s.docker.logs(ctx, ce.id, s.logTail)
+				if err != nil {
+					log.Printf("Error: %s", err)
+				}
+			}
+			updates <- st
+		}
+
+		// Cancelled.
+		if err := ctx.Err(); err != nil {
+			return n, 0, err
+		}
+	}
+}
+
+// open starts streaming events from the docker daemon, or the replay file.
+func (s *dockerStream) open(ctx context.Context, f stepFilter) (io.ReadCloser, error) {
+	if s.replay != "" {
+		return os.Open(s.replay)
+	}
+	res, err := s.docker.get(ctx, "/events", url.Values{
+		"since":   {s.since},
+		"filters": {f.eventFilters()},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("requesting docker events: %w", err)
+	}
+	return res.Body, nil
+}
+
+// advance moves the stream position on to the event e, returning false if e
+// was already seen on a previous connection.
+func (s *dockerStream) advance(e containerEvent) bool {
+	key := e.action + " " + e.id + " " + e.name
+	switch {
+	case e.timeNano < s.lastNano:
+		return false
+	case e.timeNano == s.lastNano:
+		if s.lastSeen[key] {
+			return false
+		}
+	default:
+		s.lastNano = e.timeNano
+		s.lastSeen = make(map[string]bool, 1)
+		s.since = dockerTime(e.timeNano)
+	}
+	s.lastSeen[key] = true
+	return true
+}
+
+// resolve fills in the container name and exit code missing from legacy
+// events by inspecting the container.
+func (s *dockerStream) resolve(ctx context.Context, e *containerEvent) {
+	if e.id == "" || s.docker == nil {
+		return
+	}
+	if e.name == "" {
+		e.name = s.names[e.id]
+	}
+	if e.name != "" && (e.action != "die" || e.exitCode != "") {
+		return
+	}
+
+	c, err := s.docker.inspect(ctx, e.id)
+	if err != nil {
+		log.Printf("Error: %s", err)
+		return
+	}
+	if s.names == nil {
+		s.names = make(map[string]string)
+	}
+	s.names[e.id] = strings.TrimPrefix(c.Name, "/")
+	e.name = s.names[e.id]
+	if e.action == "die" && e.exitCode == "" {
+		e.exitCode = strconv.Itoa(c.State.ExitCode)
+	}
+}
+
+// oomKilled returns whether the container with ID id was killed for running
+// out of memory, either from a previous oom event or by inspecting it.
+func (s *dockerStream) oomKilled(ctx context.Context, id string) bool {
+	if s.ooms[id] {
+		return true
+	}
+	if id == "" || s.docker == nil {
+		return false
+	}
+	c, err := s.docker.inspect(ctx, id)
+	if err != nil {
+		log.Printf("Error: %s", err)
+		return false
+	}
+	return c.State.OOMKilled
+}
+
+// stepUpdate converts the container event e into an update for a build step,
+// returning false if the event isn't about a step.
+func stepUpdate(e containerEvent, f stepFilter) (gcbStep, bool) {
+	// Filter for step container events.
+	num, ok := f.num(e.name)
+	if !ok {
+		return gcbStep{}, false
+	}
+
+	// Update the build process steps.
+	s := gcbStep{
+		num:       num,
+		id:        f.id(num, e.name),
+		container: e.id,
+	}
+	switch e.action {
+	case "start":
+		s.status = gcbStatusRunning
+		s.startNano = e.timeNano
+	case "kill":
+		s.signal = atoi(e.signal)
+		if !cancelSignal(s.signal) {
+			// Steps may survive other signals, so wait to see whether
+			// it dies.
+			s.status = gcbStatusKilled
+			break
+		}
+		s.status = gcbStatusCancelled
+		s.endNano = e.timeNano
+	case "die":
+		s.endNano = e.timeNano
+		s.exit = atoi(e.exitCode)
+		if s.exit == 0 {
+			s.status = gcbStatusDone
+		} else {
+			s.status = gcbStatusError
+		}
+	default:
+		// Skip this event.
+		return gcbStep{}, false
+	}
+	return s, true
+}
+
+// cancelSignal returns whether the signal sig sent to a step cancels it, as
+// GCB does with SIGTERM and SIGKILL. Events without a signal are taken to be
+// cancellations too.
+func cancelSignal(sig int) bool {
+	switch sig {
+	case 0, 9, 15:
+		return true
+	}
+	return false
+}
+
+// stepFilter picks out the build step containers from the others on the
+// docker daemon.
+type stepFilter struct {
+	// name matches the names of step containers, capturing the step number
+	// in its first subexpression.
+	name *regexp.Regexp
+	// labels are docker label filters of the form "key" or "key=value" that
+	// step containers must match.
+	labels []string
+	// ids are the pretty step names from the build manifest.
+	ids map[int]string
+}
+
+// stepEvents are the docker container events that change the state of a step.
+var stepEvents = []string{"start", "die", "kill", "oom"}
+
+// num returns the step number of the container called name, or false if it
+// isn't a step container.
+func (f stepFilter) num(name string) (int, bool) {
+	m := f.name.FindStringSubmatch(name)
+	if m == nil {
+		return 0, false
+	}
+	return atoi(m[1]), true
+}
+
+// id returns the pretty name of step num from the manifest, falling back to
+// its container name.
+func (f stepFilter) id(num int, name string) string {
+	if id := f.ids[num]; id != "" {
+		return id
+	}
+	return name
+}
+
+// eventFilters returns the docker filters for step container events. The
+// events API can't filter on a name pattern, so those are matched by num.
+func (f stepFilter) eventFilters() string {
+	return dockerFilters(map[string][]string{
+		"type":  {"container"},
+		"event": stepEvents,
+		"label": f.labels,
+	})
+}
+
+// containerFilters returns the docker filters for listing step containers.
+func (f stepFilter) containerFilters() string {
+	return dockerFilters(map[string][]string{
+		"name":  {f.name.String()},
+		"label": f.labels,
+	})
+}
+
+// dockerFilters encodes the filters as the docker API's filters query
+// parameter, leaving out any that are empty.
+func dockerFilters(filters map[string][]string) string {
+	m := make(map[string][]string, len(filters))
+	for k, v := range filters {
+		if len(v) > 0 {
+			m[k] = v
+		}
+	}
+	b, _ := json.Marshal(m)
+	return string(b)
+}
+
+// dockerTime formats the Unix nanoseconds ns as a docker API timestamp.
+func dockerTime(ns int64) string {
+	return fmt.Sprintf("%d.%09d", ns/int64(time.Second), ns%int64(time.Second))
+}
+
+type dockerEvent struct {
+	Type     string      `json:"Type,omitempty"`
+	Action   string      `json:"Action,omitempty"`
+	Actor    dockerActor `json:"Actor,omitempty"`
+	Scope    string      `json:"scope,omitempty"`
+	Time     int64       `json:"time,omitempty"`
+	TimeNano int64       `json:"timeNano,omitempty"`
+	Status   string      `json:"status,omitempty"`
+	ID       string      `json:"id,omitempty"`
+	From     string      `json:"from,omitempty"`
+}
+
+// normalise returns the container event described by e, which may be in the
+// legacy format of API versions before 1.22, without Type, Action or Actor.
+func (e dockerEvent) normalise() containerEvent {
+	c := containerEvent{
+		action:   e.Action,
+		id:       e.Actor.ID,
+		name:     e.Actor.Attributes.Name,
+		exitCode: e.Actor.Attributes.ExitCode,
+		signal:   e.Actor.Attributes.Signal,
+		timeNano: e.TimeNano,
+	}
+	if c.action == "" {
+		c.action = e.Status
+	}
+	if c.id == "" {
+		c.id = e.ID
+	}
+	if c.timeNano == 0 {
+		c.timeNano = e.Time * int64(time.Second)
+	}
+	return c
+}
+
+// recordedEvent is a raw docker event as recorded with the time we received
+// it.
+type recordedEvent struct {
+	Time  time.Time       `json:"time"`
+	Event json.RawMessage `json:"event"`
+}
+
+// containerEvent is a docker container event in either of the event formats.
+type containerEvent struct {
+	action   string
+	id       string
+	name     string
+	exitCode string
+	signal   string
+	timeNano int64
+}
+
+type dockerActor struct {
+	ID         string     `json:"ID,omitempty"`
+	Attributes dockerAttr `json:"Attributes"`
+}
+
+type dockerAttr struct {
+	Driver      string `json:"driver,omitempty"`
+	Image       string `json:"image,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Container   string `json:"container,omitempty"`
+	Type        string `json:"type,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	Propagation string `json:"propagation,omitempty"`
+	ReadWrite   string `json:"read/write,omitempty"`
+	ExitCode    string `json:"exitCode,omitempty"`
+	Signal      string `json:"signal,omitempty"`
+}
+
+type dockerContainer struct {
+	ID    string   `json:"Id"`
+	Names []string `json:"Names"`
+	State string   `json:"State"`
+}
+
+type dockerContainerJSON struct {
+	ID    string               `json:"Id"`
+	Name  string               `json:"Name"`
+	State dockerContainerState `json:"State"`
+}
+
+type dockerContainerState struct {
+	Status     string    `json:"Status"`
+	Running    bool      `json:"Running"`
+	OOMKilled  bool      `json:"OOMKilled"`
+	ExitCode   int       `json:"ExitCode"`
+	StartedAt  time.Time `json:"StartedAt"`
+	FinishedAt time.Time `json:"FinishedAt"`
+}
+
+type dockerVersion struct {
+	Version       string `json:"Version"`
+	APIVersion    string `json:"ApiVersion"`
+	MinAPIVersion string `json:"MinAPIVersion"`
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ghApp authenticates to GitHub as an installation of a GitHub App, caching
+// the installation token until shortly before it expires.
+type ghApp struct {
+	id  string
+	key *rsa.PrivateKey
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// newGHApp returns the GitHub App with the id, authenticating with its PEM
+// encoded private key.
+func newGHApp(id string, key []byte) (*ghApp, error) {
+	b, _ := pem.Decode(key)
+	if b == nil {
+		return nil, errors.New("no PEM private key found")
+	}
+	switch b.Type {
+	case "RSA PRIVATE KEY":
+		k, err := x509.ParsePKCS1PrivateKey(b.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return &ghApp{id: id, key: k}, nil
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rk, ok := k.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%T private key isn't an RSA key", k)
+		}
+		return &ghApp{id: id, key: rk}, nil
+	}
+	return nil, fmt.Errorf("unsupported %q PEM block", b.Type)
+}
+
+// installationToken returns a token for the app's installation on the repo
+// c.User/c.Repo, exchanging a new one if the last is about to expire.
+func (a *ghApp) installationToken(c buildContext) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Until(a.expires) > 5*time.Minute {
+		return a.token, nil
+	}
+
+	// Find the installation on the repo.
+	jwt, err := a.jwt(time.Now())
+	if err != nil {
+		return "", fmt.Errorf("signing github app jwt: %w", err)
+	}
+	var inst struct {
+		ID int64 `json:"id"`
+	}
+	uri := c.GitHub + "/repos/" + url.PathEscape(c.User) + "/" + url.PathEscape(c.Repo) + "/installation"
+	if err := ghAppRequest(http.MethodGet, uri, jwt, http.StatusOK, &inst); err != nil {
+		return "", fmt.Errorf("finding github app installation: %w", err)
+	}
+
+	// Exchange it for a token.
+	var tok struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	uri = c.GitHub + "/app/installations/" + strconv.FormatInt(inst.ID, 10) + "/access_tokens"
+	if err := ghAppRequest(http.MethodPost, uri, jwt, http.StatusCreated, &tok); err != nil {
+		return "", fmt.Errorf("getting github app installation token: %w", err)
+	}
+	a.token, a.expires = tok.Token, tok.ExpiresAt
+	return a.token, nil
+}
+
+// jwt returns the app's RS256 signed JSON web token, valid for a few minutes
+// around now.
+func (a *ghApp) jwt(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		// Allow for clock drift.
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": a.id,
+	})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// ghAppRequest makes the request to uri authenticated by the app's jwt, and
+// decodes the response into v if it has the status exp.
+func ghAppRequest(method, uri, jwt string, exp int, v interface{}) error {
+	req, err := http.NewRequest(method, uri, bytes.NewReader(nil))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	// Getting another token is harmless.
+	idempotent(req)
+	res, err := doGitHub(req, time.Now().Add(ghPendingRetry))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != exp {
+		b, _ := httputil.DumpResponse(res, true)
+		return fmt.Errorf("%s response from github:\n%s", res.Status, b)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ghClient is the HTTP client for the GitHub API, which gives up on slow
+// requests so that they can be retried.
+var ghClient = &http.Client{Timeout: 10 * time.Second}
+
+// ghPendingRetry is how long to keep retrying updates that aren't terminal,
+// which the next update will supersede anyway.
+const ghPendingRetry = 10 * time.Second
+
+// ghDeadline returns when to stop retrying an update to GitHub: terminal
+// updates get the build's whole GitHub retry timeout.
+func ghDeadline(build buildContext, terminal bool) time.Time {
+	if terminal {
+		return time.Now().Add(build.ghRetry)
+	}
+	return time.Now().Add(ghPendingRetry)
+}
+
+// doGitHub sends the GitHub API request, retrying network errors, server
+// errors and rate limits with backoff until the deadline. POSTs could create
+// something twice, so unless they're marked as idempotent, as with net/http,
+// they're only retried when GitHub can't have acted on them: when rate limited
+// or failing to connect. Responses that aren't retried are returned as they
+// are for the caller to check.
+func doGitHub(req *http.Request, deadline time.Time) (*http.Response, error) {
+	_, key := req.Header["Idempotency-Key"]
+	_, xKey := req.Header["X-Idempotency-Key"]
+	replayable := req.Method != http.MethodPost || key || xKey
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		res, err := ghClient.Do(req)
+		wait, retry := ghRetryAfter(res, err, backoff, replayable)
+		if !retry {
+			return res, err
+		}
+
+		// Back off, unless we'd be waiting past the deadline.
+		if time.Now().Add(wait).After(deadline) {
+			return res, err
+		}
+		why := fmt.Sprint(err)
+		if res != nil {
+			why = res.Status
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+		log.Printf("Retrying GitHub request %s in %s after attempt %d: %s.", req.URL.Path, wait.Round(time.Millisecond), attempt, why)
+		time.Sleep(wait)
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+// ghRetryAfter returns how long to wait before retrying the request that
+// returned res and err, and whether to retry it at all. Rate limited requests
+// wait for as long as GitHub asks, and others back off by around backoff.
+// Requests that aren't replayable are only retried if they can't have been
+// acted on.
+func ghRetryAfter(res *http.Response, err error, backoff time.Duration, replayable bool) (time.Duration, bool) {
+	// Add jitter of up to half the backoff.
+	jittered := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	if err != nil {
+		var op *net.OpError
+		return jittered, replayable || (errors.As(err, &op) && op.Op == "dial")
+	}
+
+	// Rate limits, primary and secondary.
+	rateLimited := res.StatusCode == http.StatusTooManyRequests
+	if res.StatusCode == http.StatusForbidden {
+		rateLimited = res.Header.Get("Retry-After") != "" || res.Header.Get("X-RateLimit-Remaining") == "0"
+		if !rateLimited {
+			// Secondary rate limits are only told apart by their message.
+			b, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			res.Body = ioutil.NopCloser(strings.NewReader(string(b)))
+			rateLimited = strings.Contains(strings.ToLower(string(b)), "secondary rate limit")
+		}
+	}
+	if rateLimited {
+		if s, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+			return time.Duration(s) * time.Second, true
+		}
+		if res.Header.Get("X-RateLimit-Remaining") == "0" {
+			if reset, err := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+				if wait := time.Until(time.Unix(reset, 0)); wait > 0 {
+					return wait, true
+				}
+			}
+		}
+		// Secondary rate limits without advice call for at least a
+		// minute's wait.
+		if backoff < time.Minute {
+			return time.Minute, true
+		}
+		return jittered, true
+	}
+
+	// Server errors.
+	return jittered, replayable && res.StatusCode >= 500
+}
+
+// idempotent marks the POST request req as safe to retry, as net/http does,
+// without sending an Idempotency-Key header.
+func idempotent(req *http.Request) *http.Request {
+	req.Header["Idempotency-Key"] = nil
+	return req
+}
+
+// getGitHubJSON gets the path of the repo build.User/build.Repo from the GitHub
+// API, decoding the response into v.
+func getGitHubJSON(build buildContext, path string, v interface{}) error {
+	req, err := newGHRepoReq(build, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	res, err := doGitHub(req, ghDeadline(build, false))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := httputil.DumpResponse(res, true)
+		return fmt.Errorf("%s response from github:\n%s", res.Status, b)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
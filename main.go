@@ -16,19 +16,19 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"syscall"
+	"text/template"
 	"time"
-
-	yaml "gopkg.in/yaml.v3"
+	"unicode"
 )
 
 func main() {
@@ -47,35 +47,104 @@ func main() {
 func run(ctx context.Context) (err error) {
 	// Read the envvars.
 	build := buildContext{
-		Docker: os.Getenv("DOCKER_HOST"),
+		Docker:          os.Getenv("DOCKER_HOST"),
+		DockerTLS:       os.Getenv("DOCKER_TLS"),
+		DockerTLSVerify: os.Getenv("DOCKER_TLS_VERIFY"),
+		DockerCertPath:  os.Getenv("DOCKER_CERT_PATH"),
+		DockerReconnect: os.Getenv("DOCKER_RECONNECT_TIMEOUT"),
+		StepPattern:     os.Getenv("STEP_NAME_PATTERN"),
+		Labels:          os.Getenv("STEP_LABELS"),
+		LogTail:         os.Getenv("LOG_TAIL_LINES"),
+		Record:          os.Getenv("DOCKER_EVENTS_RECORD"),
+		Replay:          os.Getenv("DOCKER_EVENTS_FILE"),
+		ReplayRealtime:  os.Getenv("DOCKER_EVENTS_REALTIME"),
 
 		Project:  os.Getenv("PROJECT_ID"),
 		Region:   os.Getenv("LOCATION"), // [sic]
 		ID:       os.Getenv("BUILD_ID"),
 		Manifest: os.Getenv("BUILD_MANIFEST"),
 
+		Source:     os.Getenv("BUILD_SOURCE"),
+		CloudBuild: os.Getenv("CLOUDBUILD_API"),
+		Metadata:   os.Getenv("GCE_METADATA_HOST"),
+
 		GitHub:  os.Getenv("GITHUB_API"),
 		Token:   os.Getenv("GITHUB_TOKEN"),
 		User:    os.Getenv("GITHUB_USER"),
 		Repo:    os.Getenv("GITHUB_REPO"),
 		SHA:     os.Getenv("COMMIT_SHA"),
 		Context: os.Getenv("STATUS_CONTEXT"),
+		Routes:  os.Getenv("STATUS_CONTEXTS"),
+
+		Deploys: os.Getenv("DEPLOY_ENVIRONMENTS"),
+
+		PR:     os.Getenv("_PR_NUMBER"),
+		Branch: os.Getenv("_HEAD_BRANCH"),
+
+		DescTemplate:  os.Getenv("STATUS_DESCRIPTION_TEMPLATE"),
+		URLTemplate:   os.Getenv("STATUS_URL_TEMPLATE"),
+		TitleTemplate: os.Getenv("CHECK_TITLE_TEMPLATE"),
+
+		Reporter:    os.Getenv("GITHUB_REPORTER"),
+		GitHubRetry: os.Getenv("GITHUB_RETRY_TIMEOUT"),
+
+		AppID:      os.Getenv("GITHUB_APP_ID"),
+		AppKey:     os.Getenv("GITHUB_APP_PRIVATE_KEY"),
+		AppKeyFile: os.Getenv("GITHUB_APP_PRIVATE_KEY_FILE"),
 	}
 
-	if build.Token == "" {
-		return errors.New(`envvar GITHUB_TOKEN ("user:token", ":token" or "token") is required`)
+	// When replaying recorded events without a token, print the updates
+	// rather than sending them to GitHub.
+	post := updateGitHub
+	postCheck := (&ghChecks{}).update
+	postComment := (&ghComments{}).update
+	postDeploy := (&ghDeployments{}).update
+	printing := build.Replay != "" && build.Token == "" && build.AppID == ""
+	if printing {
+		post = printUpdate
+		postCheck = printCheck
+		postComment = printComment
+		postDeploy = printDeploy
+	} else {
+		if build.Token == "" && build.AppID == "" {
+			return errors.New(`envvar GITHUB_TOKEN ("user:token", ":token" or "token") or GITHUB_APP_ID is required`)
+		}
+		if build.User == "" {
+			return errors.New(`envvar GITHUB_USER (the "user" in "github.com/user/repo") is required`)
+		}
+		if build.Repo == "" {
+			return errors.New(`envvar GITHUB_REPO (the "repo" in "github.com/user/repo") is required`)
+		}
+		if build.SHA == "" && build.Source != "api" {
+			return errors.New(`envvar COMMIT_SHA is required`)
+		}
 	}
-	if build.User == "" {
-		return errors.New(`envvar GITHUB_USER (the "user" in "github.com/user/repo") is required`)
+	if build.Docker == "" {
+		build.Docker = "unix:///var/run/docker.sock"
 	}
-	if build.Repo == "" {
-		return errors.New(`envvar GITHUB_REPO (the "repo" in "github.com/user/repo") is required`)
+	if build.DockerReconnect == "" {
+		build.DockerReconnect = "1m"
 	}
-	if build.SHA == "" {
-		return errors.New(`envvar COMMIT_SHA is required`)
+	reconnect, err := time.ParseDuration(build.DockerReconnect)
+	if err != nil {
+		return fmt.Errorf("envvar DOCKER_RECONNECT_TIMEOUT: %w", err)
 	}
-	if build.Docker == "" {
-		build.Docker = "unix:///var/run/docker.sock"
+	if build.StepPattern == "" {
+		build.StepPattern = `^step_([0-9]+)$`
+	}
+	stepPattern, err := regexp.Compile(build.StepPattern)
+	if err != nil {
+		return fmt.Errorf("envvar STEP_NAME_PATTERN: %w", err)
+	}
+	if stepPattern.NumSubexp() < 1 {
+		return errors.New(`envvar STEP_NAME_PATTERN must capture the step number, as in "^step_([0-9]+)$"`)
+	}
+	if build.LogTail == "" {
+		build.LogTail = "20"
+	}
+	logTail, err := strconv.Atoi(build.LogTail)
+	if err != nil {
+		return fmt.Errorf("envvar LOG_TAIL_LINES: %w", err)
 	}
 	if build.Region == "" {
 		log.Println("Region not found: setting to 'global'.")
@@ -87,24 +156,212 @@ func run(ctx context.Context) (err error) {
 	if build.Context == "" {
 		build.Context = "gcb"
 	}
+	if build.GitHubRetry == "" {
+		build.GitHubRetry = "2m"
+	}
+	build.ghRetry, err = time.ParseDuration(build.GitHubRetry)
+	if err != nil {
+		return fmt.Errorf("envvar GITHUB_RETRY_TIMEOUT: %w", err)
+	}
+	if build.AppID != "" {
+		key := []byte(build.AppKey)
+		if build.AppKeyFile != "" {
+			key, err = os.ReadFile(build.AppKeyFile)
+			if err != nil {
+				return fmt.Errorf("envvar GITHUB_APP_PRIVATE_KEY_FILE: %w", err)
+			}
+		}
+		build.App, err = newGHApp(build.AppID, key)
+		if err != nil {
+			return fmt.Errorf("envvar GITHUB_APP_PRIVATE_KEY: %w", err)
+		}
+	}
+	switch build.Reporter {
+	case "":
+		build.Reporter = "statuses"
+	case "statuses", "checks":
+	default:
+		return fmt.Errorf(`envvar GITHUB_REPORTER must be "statuses" or "checks", not %q`, build.Reporter)
+	}
+	if build.descTmpl, err = parseTemplate("STATUS_DESCRIPTION_TEMPLATE", build.DescTemplate); err != nil {
+		return fmt.Errorf("envvar STATUS_DESCRIPTION_TEMPLATE: %w", err)
+	}
+	if build.urlTmpl, err = parseTemplate("STATUS_URL_TEMPLATE", build.URLTemplate); err != nil {
+		return fmt.Errorf("envvar STATUS_URL_TEMPLATE: %w", err)
+	}
+	if build.titleTmpl, err = parseTemplate("CHECK_TITLE_TEMPLATE", build.TitleTemplate); err != nil {
+		return fmt.Errorf("envvar CHECK_TITLE_TEMPLATE: %w", err)
+	}
+	routes, err := parseContextRoutes(build.Routes)
+	if err != nil {
+		return fmt.Errorf("envvar STATUS_CONTEXTS: %w", err)
+	}
+	deploys, err := parseContextRoutes(build.Deploys)
+	if err != nil {
+		return fmt.Errorf("envvar DEPLOY_ENVIRONMENTS: %w", err)
+	}
+
+	// Parse the build manifest for pretty step names and timeouts, from the
+	// cloud build API if asked, falling back to the manifest file.
+	var mani manifest
+	switch build.Source {
+	case "", "file":
+		mani = readManifest(build.Manifest, os.Environ())
+	case "api":
+		if build.CloudBuild == "" {
+			build.CloudBuild = "https://cloudbuild.googleapis.com"
+		}
+		if build.Metadata == "" {
+			build.Metadata = "metadata.google.internal"
+		}
+		mani, err = fetchManifest(ctx, build, os.Environ())
+		if err != nil {
+			log.Printf("Error: %s: reading build manifest instead.", err)
+			mani = readManifest(build.Manifest, os.Environ())
+		}
+		if build.SHA == "" {
+			build.SHA = mani.subs["COMMIT_SHA"]
+		}
+		if build.SHA == "" && !printing {
+			return errors.New(`envvar COMMIT_SHA is required when the build has no COMMIT_SHA substitution`)
+		}
+	default:
+		return fmt.Errorf(`envvar BUILD_SOURCE must be "file" or "api", not %q`, build.Source)
+	}
+	if build.PR == "" {
+		build.PR = mani.subs["_PR_NUMBER"]
+	}
+	if build.Branch == "" {
+		build.Branch = mani.subs["_HEAD_BRANCH"]
+	}
+	if build.PR != "" {
+		if _, err := strconv.Atoi(build.PR); err != nil {
+			return fmt.Errorf("envvar _PR_NUMBER: %w", err)
+		}
+	}
+	routeContexts(mani, routes, build.Context)
+	filter := stepFilter{
+		name: stepPattern,
+		ids:  mani.ids(),
+	}
+	if build.Labels != "" {
+		filter.labels = strings.Split(build.Labels, ",")
+	}
+
+	// Queue the steps of the build manifest until they start.
+	numSteps := len(mani.steps)
+	steps := make(map[int]gcbStep, numSteps+10)
+	for n := range mani.steps {
+		steps[n] = gcbStep{
+			status: gcbStatusQueued,
+			num:    n,
+			id:     filter.id(n, "step_"+strconv.Itoa(n)),
+		}
+	}
 
-	// Parse the build manifest for pretty step names.
-	ids := readManifestIDs(build.Manifest)
+	// Rebuild the state of any steps that started before we did, so that we
+	// only need to follow live events. If we can't, fall back to replaying
+	// the daemon's event history.
+	stream := &dockerStream{
+		logTail:  logTail,
+		replay:   build.Replay,
+		realtime: build.ReplayRealtime != "",
+	}
+	if build.Replay == "" {
+		stream.docker, err = newDockerClient(build.Docker, build.DockerCertPath, build.DockerTLS != "", build.DockerTLSVerify != "")
+		if err != nil {
+			return err
+		}
+		if err := stream.docker.negotiate(ctx); err != nil {
+			log.Printf("Error negotiating docker API version: %s", err)
+		} else {
+			log.Printf("Using docker API version %s.", stream.docker.version)
+		}
+		stream.since = dockerTime(time.Now().UnixNano())
+		seeded, err := dockerSteps(ctx, stream.docker, filter)
+		if err != nil {
+			log.Printf("Error: %s: replaying docker events instead.", err)
+			stream.since = "10"
+		}
+		for _, s := range seeded {
+			updateSteps(mani, steps, s)
+			log.Printf("GCB step: %#v.", s)
+		}
+	}
 
-	// Get a stream of GCB step events.
+	// Record the events for debugging.
+	if build.Record != "" {
+		f, err := os.OpenFile(build.Record, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("opening docker events record: %w", err)
+		}
+		defer f.Close()
+		stream.record = f
+	}
+
+	// Get a stream of GCB step events, collecting the stats of steps that
+	// are already running.
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	defer logReport(steps)
+	for _, s := range steps {
+		if s.status == gcbStatusRunning {
+			stream.watchStats(ctx, s.container)
+		}
+	}
 	dockerErrs := make(chan error, 1)
 	gcbUpdates := make(chan gcbStep, 10)
 	go func() {
 		defer close(dockerErrs)
-		dockerErrs <- dockerUpdates(ctx, build.Docker, gcbUpdates, ids)
+		dockerErrs <- dockerUpdates(ctx, stream, reconnect, gcbUpdates, filter)
 	}()
 
-	// Send updates to GitHub after each change, or every 10 seconds.
-	numSteps := len(ids)
-	steps := make(map[int]gcbStep, numSteps+10)
-	kick := time.NewTimer(time.Hour)
+	// Send updates to GitHub after each change, or every 10 seconds. Replaying
+	// as fast as possible, send an update for every change instead.
+	debounce := 20 * time.Millisecond
+	if build.Replay != "" && !stream.realtime {
+		debounce = 0
+	}
+	wait := time.Hour
+	if len(steps) > 0 {
+		wait = 20 * time.Millisecond
+	}
+	kick := time.NewTimer(wait)
+	// The final states sent to each status context, which we stop updating.
+	finals := make(map[string]ghCommitState)
+	sender := newGHSender(func(u ghUpdate) error {
+		log.Printf("GH update: %#v.", u.status)
+		if u.check != nil {
+			return postCheck(build, *u.check)
+		}
+		return post(build, u.status)
+	})
+	senders := []*ghSender{sender}
+	// Pull request builds also keep a comment on the PR up to date.
+	var comments *ghSender
+	if build.PR != "" {
+		comments = newGHSender(func(u ghUpdate) error {
+			log.Printf("GH comment update on PR #%s.", build.PR)
+			return postComment(build, u.comment, u.final)
+		})
+		senders = append(senders, comments)
+	}
+	// Deploy steps are also reported as deployments to their environments.
+	var deployments *ghSender
+	if len(deploys) > 0 {
+		deployments = newGHSender(func(u ghUpdate) error {
+			log.Printf("GH deployment update: %#v.", *u.deploy)
+			return postDeploy(build, *u.deploy, u.final)
+		})
+		senders = append(senders, deployments)
+	}
+	// Send whatever has been queued before returning early too, such as on
+	// losing the docker daemon.
+	defer func() {
+		for _, s := range senders {
+			s.flush()
+		}
+	}()
 	for {
 		select {
 		case s := <-gcbUpdates:
@@ -113,40 +370,22 @@ func run(ctx context.Context) (err error) {
 				gcbUpdates = nil
 				break
 			}
-			if steps[s.num].status == gcbStatusCancelled {
-				// Each step dies with a nonzero exit code after being
-				// cancelled, appearing as an error. Leave it as cancelled.
-				continue
-			}
 
 			// Update this step.
-			if s.startNano == 0 {
-				s.startNano = steps[s.num].startNano
+			if !updateSteps(mani, steps, s) {
+				continue
 			}
-			steps[s.num] = s
 			log.Printf("GCB step: %#v.", s)
 
-			// If this build step was killed, mark anything still running as
-			// cancelled. This would happen anyway - we'd see cancellations
-			// coming from Docker - but we want the first failure to be our last
-			// update to GitHub so that it doesn't send many slack messages.
-			if s.status == gcbStatusError {
-				for n, step := range steps {
-					if step.status != gcbStatusRunning {
-						continue
-					}
-					step.status = gcbStatusCancelled
-					step.endNano = s.endNano
-					steps[n] = step
-				}
-			}
-
 			// Schedule an update to GitHub, if nothing else happens first.
-			// Debounces the initial requests.
+			// Debounces the initial requests, but not the last.
+			if debounce == 0 || (numSteps > 0 && buildDone(steps)) {
+				break
+			}
 			if !kick.Stop() {
 				<-kick.C
 			}
-			kick.Reset(20 * time.Millisecond)
+			kick.Reset(debounce)
 			continue
 
 		case err = <-dockerErrs:
@@ -161,158 +400,245 @@ func run(ctx context.Context) (err error) {
 			kick.Reset(10 * time.Second)
 		}
 
-		// Update GitHub.
-		gh := gcb2gh(build, steps, numSteps)
-		log.Printf("GH update: %#v.", gh)
-		err := updateGitHub(build, gh)
-		if err != nil {
-			log.Print("Error: ", err)
-		} else {
-			log.Print("GH updated.")
+		// Update GitHub. Replayed durations are as of the last event.
+		nowNano := time.Now().UnixNano()
+		if build.Replay != "" {
+			nowNano = lastNano(steps)
+		}
+		var state ghCommitState
+		for _, c := range stepContexts(mani, steps) {
+			if final, ok := finals[c]; ok {
+				state = worstState(state, final)
+				continue
+			}
+			// Without a build manifest, another step may yet start and
+			// switch a success back to pending.
+			gh := gcb2gh(build, mani, steps, c, nowNano)
+			u := ghUpdate{
+				context: c,
+				final:   gh.State == ghCommitStateError || (gh.State == ghCommitStateSuccess && (numSteps > 0 || gcbUpdates == nil)),
+				status:  gh,
+			}
+			if build.Reporter == "checks" {
+				run := gcb2check(build, mani, steps, c, gh, u.final, nowNano)
+				u.check = &run
+			}
+			sender.send(u)
+			if u.final {
+				finals[c] = gh.State
+			}
+			state = worstState(state, gh.State)
 		}
 
-		// Error.
-		if gh.State == ghCommitStateError {
-			return err
+		// Completion: the build failed, every step in the manifest has
+		// finished, or we've run out of docker events.
+		complete := state == ghCommitStateError || (numSteps > 0 && buildDone(steps)) || gcbUpdates == nil
+		if comments != nil && len(steps) > 0 {
+			comments.send(ghUpdate{
+				final:   complete,
+				comment: gcb2comment(build, mani, steps, state, nowNano),
+			})
+		}
+		if deployments != nil {
+			for _, s := range stepsInOrder(steps) {
+				env := deployEnvironment(deploys, s.id)
+				if env == "" {
+					continue
+				}
+				if d, ok := gcb2deploy(build, s, env); ok {
+					deployments.send(ghUpdate{
+						context: strconv.Itoa(s.num),
+						final:   s.status.finished(),
+						deploy:  &d,
+					})
+				}
+			}
+		}
+		if debounce == 0 {
+			// Replaying as fast as possible, send every update in turn.
+			for _, s := range senders {
+				s.wait()
+			}
+		}
+
+		// Make sure GitHub has the final state before we exit.
+		if complete {
+			var ghErr error
+			for _, s := range senders {
+				if err := s.flush(); ghErr == nil {
+					ghErr = err
+				}
+			}
+			if ghErr != nil {
+				return exit(exitGitHub, ghErr)
+			}
+			if state == ghCommitStatePending {
+				// We ran out of docker events with steps still to run.
+				return exit(exitIncomplete, errors.New("docker events ended before the build finished, leaving GitHub pending"))
+			}
+			log.Printf("Build complete: %s.", state)
+			return nil
 		}
 		// Cancellation.
 		if err := ctx.Err(); err != nil {
 			return err
 		}
-		// Completion.
-		if gcbUpdates == nil {
-			return err
-		}
 	}
 }
 
-// readManifestIDs parses the google cloud build manifest at mani and returns
-// the explicit id indexed against the step number. Returns an empty but non-nil
-// map if any error occurs reading the file.
-func readManifestIDs(mani string) map[int]string {
-	ids := make(map[int]string, 20)
-	if mani == "" {
-		return ids
-	}
-
-	// Open the build manifest.
-	f, err := os.Open(mani)
-	if err != nil {
-		log.Printf("Opening build manifest: %s", err)
-		return ids
+// buildDone returns whether all of the build's steps have finished: the steps
+// queued from the build manifest, or if we don't have one, all of the steps
+// we've seen.
+func buildDone(steps map[int]gcbStep) bool {
+	for _, s := range steps {
+		if !s.status.finished() {
+			return false
+		}
 	}
-	defer f.Close()
+	return len(steps) > 0
+}
 
-	// Parse the manifest step IDs.
-	type step struct {
-		ID   string `yaml:"id"`
-		Name string `yaml:"name"`
-	}
-	var c struct {
-		Steps []step `yaml:"steps"`
-	}
-	d := yaml.NewDecoder(f)
-	if err := d.Decode(&c); err != nil {
-		log.Printf("Reading build manifest %q: %s", mani, err)
-		return ids
+// anySkipped returns whether any of steps were skipped.
+func anySkipped(steps map[int]gcbStep) bool {
+	for _, s := range steps {
+		if s.status == gcbStatusSkipped {
+			return true
+		}
 	}
+	return false
+}
 
-	// Build the ID map.
-	for n, s := range c.Steps {
-		ids[n] = s.ID
+// lastNano returns the time of the most recent start or end of any of steps.
+func lastNano(steps map[int]gcbStep) int64 {
+	var last int64
+	for _, s := range steps {
+		if s.startNano > last {
+			last = s.startNano
+		}
+		if s.endNano > last {
+			last = s.endNano
+		}
 	}
-	return ids
+	return last
 }
 
-// dockerUpdates connects to Docker daemon at dockerHost monitors container
-// events, sending them back on the updates channel.
-func dockerUpdates(ctx context.Context, dockerHost string, updates chan<- gcbStep, ids map[int]string) error {
-	// Swap out the HTTP client if we're using a unix socket.
-	docker := http.DefaultClient
-	if strings.HasPrefix(dockerHost, "unix:///") {
-		path := strings.TrimPrefix(dockerHost, "unix://")
-		dockerHost = "http://docker"
-		docker = &http.Client{
-			Transport: &http.Transport{
-				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-					var d net.Dialer
-					return d.DialContext(ctx, "unix", path)
-				},
-			},
+// updateSteps applies the update s to its step in steps, working out why it
+// ended from the build manifest mani. It returns false if the update was
+// ignored.
+func updateSteps(mani manifest, steps map[int]gcbStep, s gcbStep) bool {
+	switch prev := steps[s.num]; prev.status {
+	case gcbStatusCancelled, gcbStatusTimeout:
+		// Each step dies with a nonzero exit code after being killed,
+		// appearing as an error. Leave it as it was, other than keeping
+		// its stats.
+		if s.stats.samples > 0 {
+			prev.stats = s.stats
+			steps[s.num] = prev
 		}
+		return false
+	}
+	if s.status == gcbStatusKilled && s.endNano == 0 {
+		// Signalled with something other than a cancellation. Remember
+		// the signal in case the step dies of it.
+		prev := steps[s.num]
+		prev.signal = s.signal
+		steps[s.num] = prev
+		return false
 	}
 
-	// Start the docker events stream.
-	res, err := docker.Get(dockerHost + "/events?type=container&since=10")
-	if err != nil {
-		log.Fatalf("Error requesting docker events: %s", err)
+	// Update this step.
+	if s.startNano == 0 {
+		s.startNano = steps[s.num].startNano
 	}
-	defer res.Body.Close()
-	if res.StatusCode != http.StatusOK {
-		h, _ := httputil.DumpResponse(res, true)
-		return exit(3, fmt.Errorf("%s fetching docker events:\n%s", res.Status, h))
+	if s.signal == 0 {
+		s.signal = steps[s.num].signal
 	}
+	steps[s.num] = classify(mani, steps, s)
 
-	// Loop over the events coming back from docker.
-	r := json.NewDecoder(res.Body)
-	for {
-		// Read the next event.
-		var e dockerEvent
-		err := r.Decode(&e)
-		switch err {
-		case nil:
-			// Continue.
-		default:
-			return fmt.Errorf("decoding event: %w", err)
-		case io.EOF:
-			return nil
+	// If this build step was killed, mark anything still running as
+	// cancelled. This would happen anyway - we'd see cancellations coming from
+	// Docker - but we want the first failure to be our last update to GitHub
+	// so that it doesn't send many slack messages. Anything still queued will
+	// never start.
+	if st := steps[s.num].status; st.failed() || st == gcbStatusCancelled {
+		for n, step := range steps {
+			switch step.status {
+			case gcbStatusRunning:
+				step.status = gcbStatusCancelled
+				step.endNano = s.endNano
+			case gcbStatusQueued:
+				step.status = gcbStatusSkipped
+			default:
+				continue
+			}
+			steps[n] = step
 		}
+	}
+	return true
+}
 
-		// Filter for step container events.
-		if !strings.HasPrefix(e.Actor.Attributes.Name, "step_") {
-			continue
-		}
+// classify works out why the step s ended if it didn't exit by itself: whether
+// it hit its own or the build's timeout from the build manifest mani, was
+// cancelled along with the build, or was killed by a signal from elsewhere.
+// Failures the manifest allows are marked as such.
+func classify(mani manifest, steps map[int]gcbStep, s gcbStep) gcbStep {
+	s = classifyKill(mani, steps, s)
+	if s.status.failed() && mani.allowed(s) {
+		s.status = gcbStatusAllowed
+	}
+	return s
+}
 
-		// Update the build process steps.
-		s := gcbStep{
-			num: atoi(strings.TrimPrefix(e.Actor.Attributes.Name, "step_")),
-		}
-		switch e.Action {
-		case "start":
-			s.status = gcbStatusRunning
-			s.startNano = e.TimeNano
-		case "kill":
-			s.status = gcbStatusCancelled
-			s.endNano = e.TimeNano
-		case "die":
-			s.endNano = e.TimeNano
-			s.exit = atoi(e.Actor.Attributes.ExitCode)
-			if s.exit == 0 {
-				s.status = gcbStatusDone
-			} else {
-				s.status = gcbStatusError
-			}
-		default:
-			// Skip this event.
-			continue
-		}
-		s.id = ids[s.num]
-		if s.id == "" {
-			s.id = e.Actor.Attributes.Name
-		}
-		updates <- s
+// classifyKill works out whether the killed step s timed out, was cancelled or
+// was killed by a signal.
+func classifyKill(mani manifest, steps map[int]gcbStep, s gcbStep) gcbStep {
+	switch {
+	case s.status == gcbStatusCancelled:
+		// Killed by GCB.
+	case s.status == gcbStatusError && s.signal != 0:
+		// Died after being sent a signal from elsewhere.
+		s.status = gcbStatusKilled
+	case s.status == gcbStatusError && s.exit > 128 && s.exit <= 128+64:
+		// Died from a signal.
+		s.status = gcbStatusKilled
+		s.signal = s.exit - 128
+	default:
+		return s
+	}
 
-		// Cancelled.
-		if err := ctx.Err(); err != nil {
-			return err
+	// Check for the step or the build having timed out. We don't know when
+	// the build started, so the first step will have to do.
+	buildStart := s.startNano
+	for _, step := range steps {
+		if step.startNano != 0 && step.startNano < buildStart {
+			buildStart = step.startNano
 		}
 	}
+	var stepTimeout time.Duration
+	if s.num < len(mani.steps) {
+		stepTimeout = mani.steps[s.num].timeout
+	}
+	if timedOut(s.endNano-s.startNano, stepTimeout) || timedOut(s.endNano-buildStart, mani.timeout) {
+		s.status = gcbStatusTimeout
+	}
+	return s
 }
 
-func gcb2gh(build buildContext, steps map[int]gcbStep, numSteps int) ghStatusUpdate {
-	// Build a description of the steps.
-	st := make([]gcbStep, 0, len(steps))
-	for _, s := range steps {
+// timedOut returns whether something that ran for d nanoseconds hit timeout,
+// allowing for some slack in how GCB measures it. Zero timeouts never time
+// out.
+func timedOut(d int64, timeout time.Duration) bool {
+	return timeout > 0 && time.Duration(d) >= timeout-timeout/20
+}
+
+// gcb2gh returns the GitHub status update describing the steps of the build
+// reported in the status context, or the main one if it's empty, with the
+// build manifest mani, as of the Unix nanoseconds nowNano.
+func gcb2gh(build buildContext, mani manifest, steps map[int]gcbStep, context string, nowNano int64) ghStatusUpdate {
+	// Build a description of this context's steps.
+	own := contextSteps(mani, steps, context)
+	st := make([]gcbStep, 0, len(own))
+	for _, s := range own {
 		st = append(st, s)
 	}
 	sort.Slice(st, func(i, j int) bool {
@@ -331,8 +657,10 @@ func gcb2gh(build buildContext, steps map[int]gcbStep, numSteps int) ghStatusUpd
 	})
 	var stPrev gcbStatus
 	var sb strings.Builder
-	nowNano := time.Now().UnixNano()
-	for _, s := range st {
+	for i, s := range st {
+		if mani.step(s.num).hide && !s.status.failed() {
+			continue
+		}
 		if s.status != stPrev {
 			if stPrev != 0 {
 				sb.WriteString("; ")
@@ -347,74 +675,125 @@ func gcb2gh(build buildContext, steps map[int]gcbStep, numSteps int) ghStatusUpd
 		if e == 0 {
 			e = nowNano
 		}
-		d := time.Duration(e - s.startNano)
-		if d > 10*time.Second {
+		if d := time.Duration(e - s.startNano); s.startNano != 0 && d > 10*time.Second {
 			sb.WriteString(" ")
 			sb.WriteString(fmtDuration(d))
 		}
+		if s.status == gcbStatusQueued {
+			if waiting := mani.waitingOn(steps, s.num); len(waiting) > 0 {
+				sb.WriteString(" (waiting on ")
+				for j, w := range waiting {
+					if j > 0 {
+						sb.WriteString(" & ")
+					}
+					sb.WriteString(steps[w].id)
+				}
+				sb.WriteString(")")
+			}
+		}
+		if s.status == gcbStatusKilled {
+			sb.WriteString(" (")
+			sb.WriteString(signalName(s.signal))
+			sb.WriteString(")")
+		}
+		if i == 0 && s.status.failed() {
+			// Quote the failure from the first failed step's logs.
+			if line := lastLogLine(s.logs, 60); line != "" {
+				sb.WriteString(` "`)
+				sb.WriteString(line)
+				sb.WriteString(`"`)
+			}
+		}
 		stPrev = s.status
 	}
 
-	// Trim the status.
-	status := sb.String()
-	if len(status) >= 140 {
-		status = status[:140]
-	}
-
-	// Convert build status to github status.
+	// Convert build status to github status. Failures and cancellations sort
+	// first, so the build has failed if the first step has. Steps are only
+	// skipped when a step in another context has failed the build.
 	s0 := st[0]
-	var commitState ghCommitState
-	switch s0.status {
-	case gcbStatusError:
+	commitState := ghCommitStatePending
+	switch {
+	case s0.status.failed(), s0.status == gcbStatusCancelled, anySkipped(own):
 		commitState = ghCommitStateError
-	case gcbStatusDone:
-		if numSteps == 0 || len(st) == numSteps {
-			// If the most recent step is done, we can perhaps assume that we're
-			// finished. If we don't have a build manifest there may be another
-			// step yet to start. We'll switch back to "pending" when the next
-			// step starts, but the debouncing in run() should make it very
-			// unlikely that we send a success on anything other than the last
-			// step.
-			commitState = ghCommitStateSuccess
-			break
-		}
-		fallthrough
-	case gcbStatusRunning:
-		commitState = ghCommitStatePending
+	case buildDone(own):
+		// Without a build manifest, we can perhaps assume that we're
+		// finished when no steps are running, but there may be another step
+		// yet to start. We'll switch back to "pending" when the next step
+		// starts, but the debouncing in run() should make it very unlikely
+		// that we send a success on anything other than the last step.
+		commitState = ghCommitStateSuccess
 	}
 
 	// Link to the build and directly to the first step in our sorted list,
-	// which will always be an error if a step failed.
-	target := "https://console.cloud.google.com/cloud-build/builds;region=" + build.Region + "/" + url.PathEscape(build.ID)
-	target += ";step=" + strconv.Itoa(s0.num)
-	target += "?project=" + url.QueryEscape(build.Project)
-
-	// Update the commit status in GitHub.
-	return ghStatusUpdate{
-		Context:     build.Context,
-		Description: status,
+	// which will always be an error if a step failed, or to the failed step's
+	// runbook.
+	target := stepURL(build, s0.num)
+	if runbook := mani.step(s0.num).runbook; runbook != "" && s0.status.failed() {
+		target = runbook
+	}
+	name := context
+	if name == "" {
+		name = build.Context
+	}
+	gh := ghStatusUpdate{
+		Context:     name,
+		Description: sb.String(),
 		State:       commitState,
 		TargetURL:   target,
 	}
+
+	// Render any templates of the description and target.
+	if build.descTmpl != nil || build.urlTmpl != nil {
+		view := newStatusView(build, mani, steps, context, gh, nowNano)
+		gh.Description = render(build.descTmpl, view, gh.Description)
+		gh.TargetURL = render(build.urlTmpl, view, gh.TargetURL)
+	}
+
+	// Trim the description.
+	if len(gh.Description) >= 140 {
+		gh.Description = gh.Description[:140]
+	}
+	return gh
 }
 
 type ghCommitState string
 
 const (
-	ghCommitStateError   = "error"
-	ghCommitStateSuccess = "success"
-	ghCommitStatePending = "pending"
+	ghCommitStateError   ghCommitState = "error"
+	ghCommitStateSuccess ghCommitState = "success"
+	ghCommitStatePending ghCommitState = "pending"
 )
 
+// stepURL returns the URL of the logs of the build step num in the cloud
+// console.
+func stepURL(build buildContext, num int) string {
+	target := "https://console.cloud.google.com/cloud-build/builds;region=" + build.Region + "/" + url.PathEscape(build.ID)
+	target += ";step=" + strconv.Itoa(num)
+	target += "?project=" + url.QueryEscape(build.Project)
+	return target
+}
+
+// worstState returns the worse of the commit states a and b, with errors worse
+// than pending, and pending worse than success.
+func worstState(a, b ghCommitState) ghCommitState {
+	rank := map[ghCommitState]int{ghCommitStateSuccess: 1, ghCommitStatePending: 2, ghCommitStateError: 3}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
 func updateGitHub(build buildContext, status ghStatusUpdate) error {
 	// Build the request.
 	req, err := newGHStatusUpdateReq(build, status)
 	if err != nil {
 		return fmt.Errorf("building github status request: %w", err)
 	}
+	// Setting the same status twice is harmless.
+	idempotent(req)
 
-	// Send to GitHub.
-	res, err := http.DefaultClient.Do(req)
+	// Send to GitHub, retrying terminal updates for longer.
+	res, err := doGitHub(req, ghDeadline(build, status.State != ghCommitStatePending))
 	if err != nil {
 		return fmt.Errorf("updating github status: %w", err)
 	}
@@ -431,23 +810,44 @@ func updateGitHub(build buildContext, status ghStatusUpdate) error {
 	return nil
 }
 
+// printUpdate writes the GitHub status update to stdout rather than sending
+// it, for replays.
+func printUpdate(build buildContext, status ghStatusUpdate) error {
+	return json.NewEncoder(os.Stdout).Encode(status)
+}
+
 func atoi(s string) int {
 	n, _ := strconv.Atoi(s)
 	return n
 }
 
+// Exit codes.
+const (
+	// exitOK means the build's final state was sent to GitHub.
+	exitOK = 0
+	// exitFailure means gcb2gh failed, such as with invalid configuration.
+	exitFailure = 1
+	// exitDocker means the docker daemon rejected our requests.
+	exitDocker = 3
+	// exitGitHub means the build's final state couldn't be sent to GitHub.
+	exitGitHub = 4
+	// exitIncomplete means the docker events ended before the build
+	// finished, leaving GitHub pending.
+	exitIncomplete = 5
+)
+
 // exitCode returns the process exit code for an error. If err can be unwrapped
 // to an interface { Code() int } then Code() is returned, otherwise 0 if err
 // is nil, or 1.
 func exitCode(err error) int {
 	if err == nil {
-		return 0
+		return exitOK
 	}
 	var x interface{ Code() int }
 	if errors.As(err, &x) {
 		return x.Code()
 	}
-	return 1
+	return exitFailure
 }
 
 // exit returns err wrapped with an exit code.
@@ -469,28 +869,74 @@ func (err *exitError) Unwrap() error {
 }
 
 type buildContext struct {
-	Docker string
+	Docker          string
+	DockerTLS       string
+	DockerTLSVerify string
+	DockerCertPath  string
+	DockerReconnect string
+	StepPattern     string
+	Labels          string
+	LogTail         string
+	Record          string
+	Replay          string
+	ReplayRealtime  string
 
 	Project  string
 	Region   string
 	ID       string
 	Manifest string
 
+	Source     string
+	CloudBuild string
+	Metadata   string
+
 	GitHub  string
 	Token   string
 	User    string
 	Repo    string
 	SHA     string
 	Context string
+	Routes  string
+	Deploys string
+
+	// PR and Branch are the number and head branch of the pull request
+	// being built, if any.
+	PR     string
+	Branch string
+
+	DescTemplate  string
+	URLTemplate   string
+	TitleTemplate string
+	// descTmpl, urlTmpl and titleTmpl are the parsed templates, or nil.
+	descTmpl  *template.Template
+	urlTmpl   *template.Template
+	titleTmpl *template.Template
+
+	Reporter    string
+	GitHubRetry string
+	// ghRetry is how long to retry terminal updates to GitHub for.
+	ghRetry time.Duration
+
+	AppID      string
+	AppKey     string
+	AppKeyFile string
+	// App is the GitHub App we authenticate as, if any, in place of Token.
+	App *ghApp
 }
 
 type gcbStep struct {
 	status    gcbStatus
 	num       int
 	id        string
+	container string
 	exit      int
+	signal    int
 	startNano int64
 	endNano   int64
+	// logs are the last lines logged by a failed step.
+	logs []string
+	// stats are the step's resource usage, once it has finished.
+	stats stepStats
 }
 
 type gcbStatus int
@@ -498,43 +944,37 @@ type gcbStatus int
 const (
 	gcbStatusUndef gcbStatus = iota
 	gcbStatusError
+	gcbStatusOOM
+	gcbStatusTimeout
+	gcbStatusKilled
 	gcbStatusCancelled
 	gcbStatusRunning
+	gcbStatusAllowed
 	gcbStatusDone
+	gcbStatusQueued
+	gcbStatusSkipped
 )
 
 func (s gcbStatus) String() string {
-	return [...]string{"Unknown", "Error", "Cancelled", "Running", "Done"}[s]
+	return [...]string{"Unknown", "Error", "OOM", "Timed out", "Killed", "Cancelled", "Running", "Failed (allowed)", "Done", "Queued", "Skipped"}[s]
 }
 
-type dockerEvent struct {
-	Type     string      `json:"Type,omitempty"`
-	Action   string      `json:"Action,omitempty"`
-	Actor    dockerActor `json:"Actor,omitempty"`
-	Scope    string      `json:"scope,omitempty"`
-	Time     int64       `json:"time,omitempty"`
-	TimeNano int64       `json:"timeNano,omitempty"`
-	Status   string      `json:"status,omitempty"`
-	ID       string      `json:"id,omitempty"`
-	From     string      `json:"from,omitempty"`
-}
-
-type dockerActor struct {
-	ID         string     `json:"ID,omitempty"`
-	Attributes dockerAttr `json:"Attributes"`
+// finished returns whether the status means the step won't change again.
+func (s gcbStatus) finished() bool {
+	switch s {
+	case gcbStatusUndef, gcbStatusRunning, gcbStatusQueued:
+		return false
+	}
+	return true
 }
 
-type dockerAttr struct {
-	Driver      string `json:"driver,omitempty"`
-	Image       string `json:"image,omitempty"`
-	Name        string `json:"name,omitempty"`
-	Container   string `json:"container,omitempty"`
-	Type        string `json:"type,omitempty"`
-	Destination string `json:"destination,omitempty"`
-	Propagation string `json:"propagation,omitempty"`
-	ReadWrite   string `json:"read/write,omitempty"`
-	ExitCode    string `json:"exitCode,omitempty"`
-	Signal      string `json:"signal,omitempty"`
+// failed returns whether the status means the step failed the build.
+func (s gcbStatus) failed() bool {
+	switch s {
+	case gcbStatusError, gcbStatusOOM, gcbStatusTimeout, gcbStatusKilled:
+		return true
+	}
+	return false
 }
 
 type ghStatusUpdate struct {
@@ -547,23 +987,43 @@ type ghStatusUpdate struct {
 // newGHStatusUpdateReq returns an authenticated *http.Request to set the
 // status of the commit c.SHA to s.State.
 func newGHStatusUpdateReq(c buildContext, s ghStatusUpdate) (*http.Request, error) {
-	// Marshal the body.
+	return newGHRepoReq(c, http.MethodPost, "/statuses/"+url.PathEscape(c.SHA), s)
+}
+
+// newGHRepoReq returns an authenticated *http.Request to the path of the
+// repo c.User/c.Repo in the GitHub API, with v as its JSON body.
+func newGHRepoReq(c buildContext, method, path string, v interface{}) (*http.Request, error) {
+	// Marshal the body, if any.
 	var body bytes.Buffer
-	if err := json.NewEncoder(&body).Encode(s); err != nil {
-		return nil, err
+	if v != nil {
+		if err := json.NewEncoder(&body).Encode(v); err != nil {
+			return nil, err
+		}
 	}
 
 	// Construct the request.
-	uri := c.GitHub + "/repos/" + url.PathEscape(c.User) + "/" + url.PathEscape(c.Repo) + "/statuses/" + url.PathEscape(c.SHA)
-	r, err := http.NewRequest(http.MethodPost, uri, &body)
+	uri := c.GitHub + "/repos/" + url.PathEscape(c.User) + "/" + url.PathEscape(c.Repo) + path
+	r, err := http.NewRequest(method, uri, &body)
 	if err != nil {
 		return r, err
 	}
 	r.Header.Set("Content-Type", "application/json")
 	r.Header.Set("Accept", "application/vnd.github.v3+json")
 
-	// Add authentication.
-	r.SetBasicAuth(splitUserPass(c.Token))
+	// Add authentication: a GitHub App's installation token or a bare token
+	// as a bearer token, and "user:pass" as basic auth.
+	switch {
+	case c.App != nil:
+		tok, err := c.App.installationToken(c)
+		if err != nil {
+			return r, err
+		}
+		r.Header.Set("Authorization", "Bearer "+tok)
+	case strings.Contains(c.Token, ":"):
+		r.SetBasicAuth(splitUserPass(c.Token))
+	default:
+		r.Header.Set("Authorization", "Bearer "+c.Token)
+	}
 	return r, nil
 }
 
@@ -577,6 +1037,43 @@ func splitUserPass(userPass string) (user, pass string) {
 	return userPass[:col], userPass[col+1:]
 }
 
+// lastLogLine returns the last non-blank line of logs, stripped of control
+// characters and shortened to limit bytes.
+func lastLogLine(logs []string, limit int) string {
+	for i := len(logs) - 1; i >= 0; i-- {
+		line := strings.TrimSpace(strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, ansiEscape.ReplaceAllString(logs[i], "")))
+		if line == "" {
+			continue
+		}
+		if len(line) > limit {
+			line = strings.ToValidUTF8(line[:limit-3], "") + "..."
+		}
+		return line
+	}
+	return ""
+}
+
+// ansiEscape matches the ANSI terminal escape sequences used to colour logs.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*[A-Za-z]`)
+
+// signalName returns the name of the unix signal number sig.
+func signalName(sig int) string {
+	names := map[int]string{
+		1: "SIGHUP", 2: "SIGINT", 3: "SIGQUIT", 4: "SIGILL", 5: "SIGTRAP",
+		6: "SIGABRT", 7: "SIGBUS", 8: "SIGFPE", 9: "SIGKILL", 10: "SIGUSR1",
+		11: "SIGSEGV", 12: "SIGUSR2", 13: "SIGPIPE", 14: "SIGALRM", 15: "SIGTERM",
+	}
+	if name, ok := names[sig]; ok {
+		return name
+	}
+	return "signal " + strconv.Itoa(sig)
+}
+
 // fmtDuration returns the duration d formatted to show only the two most
 // significant units of time from year, days, hours, minutes, seconds.
 func fmtDuration(d time.Duration) string {
@@ -2,7 +2,16 @@ package main_test
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"net"
 	"net/http"
@@ -10,8 +19,10 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -37,12 +48,12 @@ func TestOK(t *testing.T) {
 		},
 	})
 	exp := []commitStatus{
-		{Context: "gcb", State: "success", Description: "Done: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds/build-123;step=0?project=gcb-project"},
-		{Context: "gcb", State: "pending", Description: "Running: step_2, step_1; Done: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds/build-123;step=2?project=gcb-project"},
-		{Context: "gcb", State: "pending", Description: "Running: step_3, step_2, step_1; Done: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds/build-123;step=3?project=gcb-project"},
-		{Context: "gcb", State: "pending", Description: "Running: step_3 10s, step_2 10s, step_1 10s; Done: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds/build-123;step=3?project=gcb-project"},
-		{Context: "gcb", State: "pending", Description: "Running: step_3 10s, step_2 10s; Done: step_1 10s, step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds/build-123;step=3?project=gcb-project"},
-		{Context: "gcb", State: "error", Description: "Error: step_3 10s; Cancelled: step_2 10s; Done: step_1 10s, step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds/build-123;step=3?project=gcb-project"},
+		{Context: "gcb", State: "success", Description: "Done: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+		{Context: "gcb", State: "pending", Description: "Running: step_2, step_1; Done: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=2?project=gcb-project"},
+		{Context: "gcb", State: "pending", Description: "Running: step_3, step_2, step_1; Done: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=3?project=gcb-project"},
+		{Context: "gcb", State: "pending", Description: "Running: step_3 10s, step_2 10s, step_1 10s; Done: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=3?project=gcb-project"},
+		{Context: "gcb", State: "pending", Description: "Running: step_3 10s, step_2 10s; Done: step_1 10s, step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=3?project=gcb-project"},
+		{Context: "gcb", State: "error", Description: "Error: step_3 10s; Cancelled: step_2 10s; Done: step_1 10s, step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=3?project=gcb-project"},
 	}
 	if diff := cmp.Diff(exp, res.statuses); diff != "" {
 		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
@@ -72,98 +83,1323 @@ func TestOKManifest(t *testing.T) {
 		},
 	})
 	exp := []commitStatus{
-		{Context: "gcb", State: "pending", Description: "Done: quick", TargetURL: "https://console.cloud.google.com/cloud-build/builds/build-123;step=0?project=gcb-project"},
-		{Context: "gcb", State: "pending", Description: "Running: incomplete, slow; Done: quick", TargetURL: "https://console.cloud.google.com/cloud-build/builds/build-123;step=2?project=gcb-project"},
-		{Context: "gcb", State: "pending", Description: "Running: failure, incomplete, slow; Done: quick", TargetURL: "https://console.cloud.google.com/cloud-build/builds/build-123;step=3?project=gcb-project"},
-		{Context: "gcb", State: "pending", Description: "Running: failure 10s, incomplete 10s, slow 10s; Done: quick", TargetURL: "https://console.cloud.google.com/cloud-build/builds/build-123;step=3?project=gcb-project"},
-		{Context: "gcb", State: "pending", Description: "Running: failure 10s, incomplete 10s; Done: slow 10s, quick", TargetURL: "https://console.cloud.google.com/cloud-build/builds/build-123;step=3?project=gcb-project"},
-		{Context: "gcb", State: "error", Description: "Error: failure 10s; Cancelled: incomplete 10s; Done: slow 10s, quick", TargetURL: "https://console.cloud.google.com/cloud-build/builds/build-123;step=3?project=gcb-project"},
+		{Context: "gcb", State: "pending", Description: "Done: quick; Queued: slow, incomplete (waiting on slow), failure (waiting on incomplete)", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+		{Context: "gcb", State: "pending", Description: "Running: incomplete, slow; Done: quick; Queued: failure (waiting on incomplete)", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=2?project=gcb-project"},
+		{Context: "gcb", State: "pending", Description: "Running: failure, incomplete, slow; Done: quick", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=3?project=gcb-project"},
+		{Context: "gcb", State: "pending", Description: "Running: failure 10s, incomplete 10s, slow 10s; Done: quick", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=3?project=gcb-project"},
+		{Context: "gcb", State: "pending", Description: "Running: failure 10s, incomplete 10s; Done: slow 10s, quick", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=3?project=gcb-project"},
+		{Context: "gcb", State: "error", Description: "Error: failure 10s; Cancelled: incomplete 10s; Done: slow 10s, quick", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=3?project=gcb-project"},
 	}
 	if diff := cmp.Diff(exp, res.statuses); diff != "" {
 		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
 	}
 }
 
+func TestManifestComplete(t *testing.T) {
+	t.Parallel()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := test(t, testcase{
+		env:      []string{"BUILD_MANIFEST=" + filepath.Join(wd, "testdata/gcbtest.yaml")},
+		holdOpen: true,
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 5 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0", ExitCode: "0"}}},
+			{TimeNano: 50 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1"}}},
+			{TimeNano: 55 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_2"}}},
+			{TimeNano: 60 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_3"}}},
+			{TimeNano: 100 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1", ExitCode: "0"}}},
+			{TimeNano: 101 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_2", ExitCode: "0"}}},
+			{TimeNano: 102 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_3", ExitCode: "0"}}},
+		},
+	})
+	exp := []commitStatus{
+		{Context: "gcb", State: "pending", Description: "Done: quick; Queued: slow, incomplete (waiting on slow), failure (waiting on incomplete)", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+		{Context: "gcb", State: "pending", Description: "Running: failure, incomplete, slow; Done: quick", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=3?project=gcb-project"},
+		{Context: "gcb", State: "success", Description: "Done: failure, incomplete, slow, quick", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=3?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
+	requireLogsContain(t, res.logs, "Build complete: success.")
+}
+
 func TestContextName(t *testing.T) {
 	t.Parallel()
 	res := test(t, testcase{
-		env: []string{"STATUS_CONTEXT=gcb-test"}, // As opposed to "user:pass".
+		// The build never finishes.
+		fail: true,
+		env:  []string{"STATUS_CONTEXT=gcb-test"}, // As opposed to "user:pass".
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+		},
+	})
+	exp := []commitStatus{
+		{Context: "gcb-test", State: "pending", Description: "Running: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
+}
+
+func TestGitHubShortToken(t *testing.T) {
+	res := test(t, testcase{
+		// The build never finishes.
+		fail: true,
+		env:  []string{"GITHUB_TOKEN=token"}, // As opposed to "user:pass".
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+		},
+	})
+	if res.bearer == 0 {
+		t.Error("Expected the token to be sent as a bearer token.")
+	}
+}
+
+func TestGitHubApp(t *testing.T) {
+	t.Parallel()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := test(t, testcase{
+		appKey: key,
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 50 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0", ExitCode: "1"}}},
+		},
+	})
+	exp := []commitStatus{
+		{Context: "gcb", State: "pending", Description: "Running: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+		{Context: "gcb", State: "error", Description: "Error: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
+	if res.appTokens != 1 {
+		t.Errorf("Expected the installation token to be cached, but got %d tokens.", res.appTokens)
+	}
+}
+
+func TestBadGitHubRepo(t *testing.T) {
+	t.Parallel()
+	res := test(t, testcase{
+		fail: true,
+		env:  []string{"GITHUB_REPO=unknown"},
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+		},
+	})
+	if res.err == nil {
+		t.Fatal("Expected error but received none.")
+	}
+	requireLogsContain(t, res.logs, `404 Not Found`)
+}
+
+func TestBadGitHubToken(t *testing.T) {
+	t.Parallel()
+	res := test(t, testcase{
+		fail: true,
+		env:  []string{"GITHUB_TOKEN=bad-token"},
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+		},
+	})
+	if res.err == nil {
+		t.Fatal("Expected error but received none.")
+	}
+	requireLogsContain(t, res.logs, `Expected token "token" but got "bad-token".`)
+}
+
+func TestGitHubRetry(t *testing.T) {
+	t.Parallel()
+	res := test(t, testcase{
+		ghErrors: []int{http.StatusBadGateway, http.StatusForbidden, http.StatusTooManyRequests},
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 5 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0", ExitCode: "1"}}},
+		},
+	})
+	exp := []commitStatus{
+		{Context: "gcb", State: "error", Description: "Error: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
+	requireLogsContain(t, res.logs, "after attempt 3: 429 Too Many Requests.")
+}
+
+func TestSlowGitHub(t *testing.T) {
+	t.Parallel()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The updates queued while GitHub is slow to respond to the first are
+	// replaced by the last.
+	res := test(t, testcase{
+		env:     []string{"BUILD_MANIFEST=" + filepath.Join(wd, "testdata/timeout.yaml")},
+		ghDelay: 300 * time.Millisecond,
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 50 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0", ExitCode: "0"}}},
+			{TimeNano: 100 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1"}}},
+			{TimeNano: 200 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1", ExitCode: "0"}}},
+		},
+	})
+	exp := []commitStatus{
+		{Context: "gcb", State: "pending", Description: "Running: quick; Queued: slow (waiting on quick)", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+		{Context: "gcb", State: "success", Description: "Done: slow, quick", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=1?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
+	requireLogsContain(t, res.logs, "Build complete: success.")
+}
+
+func TestDockerFailureFlush(t *testing.T) {
+	t.Parallel()
+
+	// Updates queued behind a slow GitHub are still sent when following the
+	// docker events fails.
+	res := test(t, testcase{
+		fail:        true,
+		dockerFails: true,
+		ghDelay:     300 * time.Millisecond,
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 50 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1"}}},
+		},
+	})
+	if res.err == nil {
+		t.Fatal("Expected error but received none.")
+	}
+	requireLogsContain(t, res.logs, "500 Internal Server Error response from docker")
+	exp := []commitStatus{
+		{Context: "gcb", State: "pending", Description: "Running: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+		{Context: "gcb", State: "pending", Description: "Running: step_1, step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=1?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
+}
+
+func TestBadDockerHost(t *testing.T) {
+	t.Parallel()
+	res := test(t, testcase{
+		fail: true,
+		env:  []string{"DOCKER_HOST=unix:///dev/null"},
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+		},
+	})
+	if res.err == nil {
+		t.Fatal("Expected error but received none.")
+	}
+	requireLogsContain(t, res.logs, `dial unix /dev/null: connect: connection refused`)
+}
+
+func TestDockerReconnect(t *testing.T) {
+	t.Parallel()
+	res := test(t, testcase{
+		disconnect: 2,
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 5 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0", ExitCode: "0"}}},
+			{TimeNano: 200 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1"}}},
+			{TimeNano: 205 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1", ExitCode: "1"}}},
+		},
+	})
+	exp := []commitStatus{
+		{Context: "gcb", State: "success", Description: "Done: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+		{Context: "gcb", State: "error", Description: "Error: step_1; Done: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=1?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
+	requireLogsContain(t, res.logs, "reconnecting in")
+}
+
+func TestDockerIdleReconnect(t *testing.T) {
+	t.Parallel()
+
+	// The reconnected stream is quiet for longer than the reconnect timeout
+	// before it drops too, which doesn't mean the build is over.
+	res := test(t, testcase{
+		disconnect: 2,
+		idleDrop:   time.Second,
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 5 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0", ExitCode: "0"}}},
+			{TimeNano: 1500 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1"}}},
+			{TimeNano: 1505 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1", ExitCode: "1"}}},
+		},
+	})
+	exp := []commitStatus{
+		{Context: "gcb", State: "success", Description: "Done: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+		{Context: "gcb", State: "error", Description: "Error: step_1; Done: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=1?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
+	if strings.Contains(res.logs.String(), "assuming the build is over") {
+		t.Error("Expected the idle stream not to be taken as the end of the build.")
+	}
+}
+
+func TestDockerTLS(t *testing.T) {
+	t.Parallel()
+	res := test(t, testcase{
+		dockerTLS: true,
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 5 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0", ExitCode: "1"}}},
+		},
+	})
+	exp := []commitStatus{
+		{Context: "gcb", State: "error", Description: "Error: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
+}
+
+func TestDockerTLSWithoutCerts(t *testing.T) {
+	t.Parallel()
+	res := test(t, testcase{
+		dockerTLSAnon: true,
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 5 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0", ExitCode: "1"}}},
+		},
+	})
+	exp := []commitStatus{
+		{Context: "gcb", State: "error", Description: "Error: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
+}
+
+func TestDockerLegacyEvents(t *testing.T) {
+	t.Parallel()
+	res := test(t, testcase{
+		dockerLegacy: true,
+		containers: []testContainer{
+			{id: "c0", name: "step_0", start: 1 * ms, finish: 5 * ms},
+			{id: "c1", name: "step_1", start: 50 * ms, finish: 55 * ms, exit: 2},
+		},
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Status: "start", ID: "c0", From: "ubuntu"},
+			{TimeNano: 5 * ms, Status: "die", ID: "c0", From: "ubuntu"},
+			{TimeNano: 50 * ms, Status: "start", ID: "c1", From: "ubuntu"},
+			{TimeNano: 55 * ms, Status: "die", ID: "c1", From: "ubuntu"},
+		},
+	})
+	exp := []commitStatus{
+		{Context: "gcb", State: "success", Description: "Done: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+		{Context: "gcb", State: "error", Description: "Error: step_1; Done: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=1?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
+	requireLogsContain(t, res.logs, "Using docker API version 1.21.")
+}
+
+func TestStepNamePattern(t *testing.T) {
+	t.Parallel()
+	res := test(t, testcase{
+		env:    []string{"STEP_NAME_PATTERN=^build-([0-9]+)$", "STEP_LABELS=gcb2gh.step,team=ci"},
+		labels: []string{"gcb2gh.step", "team=ci"},
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "build-0"}}},
+			{TimeNano: 2 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1"}}},
+			{TimeNano: 5 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "build-0", ExitCode: "0"}}},
+			{TimeNano: 50 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1", ExitCode: "1"}}},
+		},
+	})
+	exp := []commitStatus{
+		{Context: "gcb", State: "success", Description: "Done: build-0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
+}
+
+func TestOOM(t *testing.T) {
+	t.Parallel()
+	res := test(t, testcase{
+		containers: []testContainer{
+			{id: "c0", name: "step_0", start: 1 * ms, finish: 5 * ms},
+			{id: "c1", name: "step_1", start: 50 * ms, finish: 55 * ms, exit: 137, oom: true},
+		},
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{ID: "c0", Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 5 * ms, Type: "container", Action: "die", Actor: dockerActor{ID: "c0", Attributes: dockerAttr{Name: "step_0", ExitCode: "0"}}},
+			{TimeNano: 50 * ms, Type: "container", Action: "start", Actor: dockerActor{ID: "c1", Attributes: dockerAttr{Name: "step_1"}}},
+			{TimeNano: 55 * ms, Type: "container", Action: "die", Actor: dockerActor{ID: "c1", Attributes: dockerAttr{Name: "step_1", ExitCode: "137"}}},
+		},
+	})
+	exp := []commitStatus{
+		{Context: "gcb", State: "success", Description: "Done: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+		{Context: "gcb", State: "error", Description: "OOM: step_1; Done: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=1?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
+}
+
+func TestStepTimeout(t *testing.T) {
+	t.Parallel()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := test(t, testcase{
+		env: []string{"BUILD_MANIFEST=" + filepath.Join(wd, "testdata/timeout.yaml")},
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 5 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0", ExitCode: "0"}}},
+			{TimeNano: 50 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1"}}},
+			{TimeNano: 1_050 * ms, Type: "container", Action: "kill", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1", Signal: "9"}}},
+			{TimeNano: 1_051 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1", ExitCode: "137"}}},
+		},
+	})
+	exp := []commitStatus{
+		{Context: "gcb", State: "pending", Description: "Done: quick; Queued: slow", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+		{Context: "gcb", State: "pending", Description: "Running: slow; Done: quick", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=1?project=gcb-project"},
+		{Context: "gcb", State: "error", Description: "Timed out: slow; Done: quick", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=1?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
+}
+
+func TestIncompleteBuild(t *testing.T) {
+	t.Parallel()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Losing the docker events with steps still to run leaves GitHub
+	// pending, which gcb2gh exits 5 for.
+	res := test(t, testcase{
+		fail: true,
+		env:  []string{"BUILD_MANIFEST=" + filepath.Join(wd, "testdata/timeout.yaml")},
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+		},
+	})
+	exp := []commitStatus{
+		{Context: "gcb", State: "pending", Description: "Running: quick; Queued: slow (waiting on quick)", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
+	requireLogsContain(t, res.logs, "docker events ended before the build finished, leaving GitHub pending")
+	requireLogsContain(t, res.logs, "exit status 5")
+}
+
+func TestKillSignal(t *testing.T) {
+	t.Parallel()
+
+	// A step surviving a SIGHUP carries on, but one dying of it is reported
+	// as killed rather than cancelled.
+	res := test(t, testcase{
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 2 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1"}}},
+			{TimeNano: 50 * ms, Type: "container", Action: "kill", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1", Signal: "1"}}},
+			{TimeNano: 100 * ms, Type: "container", Action: "kill", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0", Signal: "1"}}},
+			{TimeNano: 101 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0", ExitCode: "2"}}},
+		},
+	})
+	exp := []commitStatus{
+		{Context: "gcb", State: "pending", Description: "Running: step_1, step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=1?project=gcb-project"},
+		{Context: "gcb", State: "error", Description: "Killed: step_0 (SIGHUP); Cancelled: step_1", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+	t.Parallel()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := test(t, testcase{
+		env: []string{"BUILD_MANIFEST=" + filepath.Join(wd, "testdata/waitfor.yaml")},
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 2 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1"}}},
+			{TimeNano: 100 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1", ExitCode: "1"}}},
+		},
+	})
+	exp := []commitStatus{
+		{Context: "gcb", State: "pending", Description: "Running: build, lint; Queued: test (waiting on build), deploy (waiting on lint & test)", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=1?project=gcb-project"},
+		{Context: "gcb", State: "error", Description: "Error: build; Cancelled: lint; Skipped: test, deploy", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=1?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
+	requireLogsContain(t, res.logs, "Step report: deploy: Skipped, no stats.")
+}
+
+func TestSubstitutions(t *testing.T) {
+	t.Parallel()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := test(t, testcase{
+		env: []string{
+			"BUILD_MANIFEST=" + filepath.Join(wd, "testdata/substitutions.yaml"),
+			"BRANCH_NAME=main",
+			"_SHARD=1",
+		},
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 2 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0", ExitCode: "0"}}},
+			{TimeNano: 3 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1"}}},
+			{TimeNano: 4 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1", ExitCode: "0"}}},
+			{TimeNano: 5 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_2"}}},
+			{TimeNano: 6 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_2", ExitCode: "0"}}},
+		},
+	})
+	exp := []commitStatus{
+		{Context: "gcb", State: "success", Description: "Done: price-$5-main, deploy-staging, test-1", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=2?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
+}
+
+func TestJSONManifestFallbackIDs(t *testing.T) {
+	t.Parallel()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := test(t, testcase{
+		env: []string{"BUILD_MANIFEST=" + filepath.Join(wd, "testdata/noids.json")},
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 2 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0", ExitCode: "0"}}},
+			{TimeNano: 3 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1"}}},
+			{TimeNano: 4 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1", ExitCode: "0"}}},
+			{TimeNano: 5 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_2"}}},
+			{TimeNano: 6 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_2", ExitCode: "1"}}},
+		},
+	})
+	exp := []commitStatus{
+		{Context: "gcb", State: "error", Description: "Error: bash -c; Done: go test #2, go test; Skipped: deploy", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=2?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
+}
+
+func TestCloudBuildAPI(t *testing.T) {
+	t.Parallel()
+
+	// Fake the GCE metadata server and the cloud build API.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/computeMetadata/v1/instance/service-accounts/default/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			t.Errorf("Expected metadata request to have Metadata-Flavor: Google.")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "gcp-token", "expires_in": 3599, "token_type": "Bearer"}`)
+	})
+	mux.HandleFunc("/v1/projects/gcb-project/locations/global/builds/build-123", func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "Bearer gcp-token" {
+			t.Errorf("Expected cloud build request to be authorized with the metadata token, but got %q.", auth)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{
+			"id": "build-123",
+			"buildTriggerId": "trigger-1",
+			"substitutions": {"_ENV": "prod", "COMMIT_SHA": "abc123", "TRIGGER_NAME": "pr"},
+			"steps": [
+				{"id": "build", "name": "golang"},
+				{"id": "deploy-$_ENV", "name": "gcr.io/cloud-builders/gcloud", "waitFor": ["build"]}
+			]
+		}`)
+	})
+	api := httptest.NewServer(mux)
+	t.Cleanup(api.Close)
+
+	res := test(t, testcase{
+		env: []string{
+			"BUILD_SOURCE=api",
+			"CLOUDBUILD_API=" + api.URL,
+			"GCE_METADATA_HOST=" + strings.TrimPrefix(api.URL, "http://"),
+			"COMMIT_SHA=",
+			"STATUS_DESCRIPTION_TEMPLATE={{.Description}} ({{.Build.TriggerName}} {{.Build.TriggerID}})",
+		},
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 2 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0", ExitCode: "0"}}},
+			{TimeNano: 3 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1"}}},
+			{TimeNano: 4 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1", ExitCode: "0"}}},
+		},
+	})
+	exp := []commitStatus{
+		{Context: "gcb", State: "success", Description: "Done: deploy-prod, build (pr trigger-1)", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=1?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
+	requireLogsContain(t, res.logs, `Build build-123 triggered by trigger-1 "pr".`)
+}
+
+func TestStepOptions(t *testing.T) {
+	t.Parallel()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := test(t, testcase{
+		env: []string{"BUILD_MANIFEST=" + filepath.Join(wd, "testdata/options.yaml")},
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 2 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0", ExitCode: "0"}}},
+			{TimeNano: 3 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1"}}},
+			{TimeNano: 4 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_2"}}},
+			{TimeNano: 50 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1", ExitCode: "1"}}},
+			{TimeNano: 100 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_2", ExitCode: "1"}}},
+		},
+	})
+	exp := []commitStatus{
+		{Context: "gcb", State: "pending", Description: "Running: Unit tests", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=2?project=gcb-project"},
+		{Context: "lint", State: "pending", Description: "Running: lint", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=1?project=gcb-project"},
+		{Context: "lint", State: "success", Description: "Failed (allowed): lint", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=1?project=gcb-project"},
+		{Context: "gcb", State: "error", Description: "Error: Unit tests", TargetURL: "https://example.com/runbooks/unit"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
+}
+
+func TestStatusContexts(t *testing.T) {
+	t.Parallel()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := test(t, testcase{
+		env: []string{
+			"BUILD_MANIFEST=" + filepath.Join(wd, "testdata/gcbtest.yaml"),
+			"STATUS_CONTEXTS=/^(slow|incomplete)$/=integration,fail*=*",
+		},
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 2 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0", ExitCode: "0"}}},
+			{TimeNano: 3 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1"}}},
+			{TimeNano: 4 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_2"}}},
+			{TimeNano: 5 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_3"}}},
+			{TimeNano: 50 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_3", ExitCode: "0"}}},
+			{TimeNano: 100 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1", ExitCode: "0"}}},
+			{TimeNano: 101 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_2", ExitCode: "0"}}},
+		},
+	})
+	exp := []commitStatus{
+		{Context: "gcb", State: "success", Description: "Done: quick", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+		{Context: "gcb/failure", State: "pending", Description: "Running: failure", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=3?project=gcb-project"},
+		{Context: "integration", State: "pending", Description: "Running: incomplete, slow", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=2?project=gcb-project"},
+		{Context: "gcb/failure", State: "success", Description: "Done: failure", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=3?project=gcb-project"},
+		{Context: "integration", State: "success", Description: "Done: incomplete, slow", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=2?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
+	requireLogsContain(t, res.logs, "Build complete: success.")
+}
+
+func TestSkippedContext(t *testing.T) {
+	t.Parallel()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// When lint fails, deploy is skipped, so the deploy context has failed
+	// even though its build step was done.
+	res := test(t, testcase{
+		env: []string{
+			"BUILD_MANIFEST=" + filepath.Join(wd, "testdata/waitfor.yaml"),
+			"STATUS_CONTEXTS=lint=lint,/^(build|deploy)$/=deploy",
+		},
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 2 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1"}}},
+			{TimeNano: 10 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1", ExitCode: "0"}}},
+			{TimeNano: 11 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_2"}}},
+			{TimeNano: 50 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0", ExitCode: "1"}}},
+		},
+	})
+	exp := []commitStatus{
+		{Context: "gcb", State: "pending", Description: "Running: test", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=2?project=gcb-project"},
+		{Context: "deploy", State: "pending", Description: "Done: build; Queued: deploy (waiting on lint & test)", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=1?project=gcb-project"},
+		{Context: "lint", State: "pending", Description: "Running: lint", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+		{Context: "gcb", State: "error", Description: "Cancelled: test", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=2?project=gcb-project"},
+		{Context: "deploy", State: "error", Description: "Done: build; Skipped: deploy", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=1?project=gcb-project"},
+		{Context: "lint", State: "error", Description: "Error: lint", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
+	requireLogsContain(t, res.logs, "Build complete: error.")
+}
+
+func TestChecks(t *testing.T) {
+	t.Parallel()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := test(t, testcase{
+		env: []string{
+			"BUILD_MANIFEST=" + filepath.Join(wd, "testdata/waitfor.yaml"),
+			"GITHUB_REPORTER=checks",
+		},
+		containers: []testContainer{
+			{id: "c0", name: "step_0", start: 1 * ms},
+			{id: "c1", name: "step_1", start: 2 * ms, finish: 100 * ms, exit: 2, logs: []string{"=== RUN TestBuild", "\x1b[31mpanic: oops\x1b[0m"}},
+		},
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{ID: "c0", Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 2 * ms, Type: "container", Action: "start", Actor: dockerActor{ID: "c1", Attributes: dockerAttr{Name: "step_1"}}},
+			{TimeNano: 100 * ms, Type: "container", Action: "die", Actor: dockerActor{ID: "c1", Attributes: dockerAttr{Name: "step_1", ExitCode: "2"}}},
+		},
+	})
+	if len(res.statuses) > 0 {
+		t.Errorf("Expected no commit statuses but got %d.", len(res.statuses))
+	}
+	for i, run := range res.checkRuns {
+		if (run.CompletedAt != "") != (run.Status == "completed") {
+			t.Errorf("Expected check run %d to have completed_at only once completed, but got %q.", i, run.CompletedAt)
+		}
+		res.checkRuns[i].CompletedAt = ""
+	}
+	url := "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step="
+	exp := []checkRun{{
+		Method:     "POST",
+		Path:       "/repos/unravelin/gcb2gh-test/check-runs",
+		Name:       "gcb",
+		HeadSHA:    "abc123",
+		Status:     "in_progress",
+		DetailsURL: url + "1?project=gcb-project",
+		ExternalID: "build-123",
+		Output: checkRunOutput{
+			Title: "0 of 4 steps done",
+			Summary: "| Step | State | Duration | Exit code | Logs |\n" +
+				"| --- | --- | --- | --- | --- |\n" +
+				"| lint | Running | 0s |  | [logs](" + url + "0?project=gcb-project) |\n" +
+				"| build | Running | 0s |  | [logs](" + url + "1?project=gcb-project) |\n" +
+				"| test | Queued |  |  | [logs](" + url + "2?project=gcb-project) |\n" +
+				"| deploy | Queued |  |  | [logs](" + url + "3?project=gcb-project) |\n",
+		},
+	}, {
+		Method:     "PATCH",
+		Path:       "/repos/unravelin/gcb2gh-test/check-runs/42",
+		Name:       "gcb",
+		Status:     "completed",
+		Conclusion: "failure",
+		DetailsURL: url + "1?project=gcb-project",
+		ExternalID: "build-123",
+		Output: checkRunOutput{
+			Title: `Error: build "panic: oops"; Cancelled: lint; Skipped: test, deploy`,
+			Summary: "| Step | State | Duration | Exit code | Logs |\n" +
+				"| --- | --- | --- | --- | --- |\n" +
+				"| lint | Cancelled | 0s |  | [logs](" + url + "0?project=gcb-project) |\n" +
+				"| build | Error | 0s | 2 | [logs](" + url + "1?project=gcb-project) |\n" +
+				"| test | Skipped |  |  | [logs](" + url + "2?project=gcb-project) |\n" +
+				"| deploy | Skipped |  |  | [logs](" + url + "3?project=gcb-project) |\n",
+			Text: "### build\n\n```\n=== RUN TestBuild\npanic: oops\n```\n\n",
+		},
+	}}
+	if diff := cmp.Diff(exp, res.checkRuns); diff != "" {
+		t.Errorf("Expected GitHub check runs (-) but got (+):\n%s", diff)
+	}
+}
+
+func TestSkippedCheckRun(t *testing.T) {
+	t.Parallel()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// When build fails, deploy is skipped, which fails its own check run.
+	res := test(t, testcase{
+		env: []string{
+			"BUILD_MANIFEST=" + filepath.Join(wd, "testdata/waitfor.yaml"),
+			"GITHUB_REPORTER=checks",
+			"STATUS_CONTEXTS=deploy=deploy",
+		},
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 2 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1"}}},
+			{TimeNano: 50 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1", ExitCode: "2"}}},
+		},
+	})
+	var last checkRun
+	for _, run := range res.checkRuns {
+		if run.Name == "deploy" {
+			last = run
+		}
+	}
+	if exp, act := "completed", last.Status; exp != act {
+		t.Errorf("Expected the deploy check run to be %q but got %q.", exp, act)
+	}
+	if exp, act := "cancelled", last.Conclusion; exp != act {
+		t.Errorf("Expected the deploy check run to conclude %q but got %q.", exp, act)
+	}
+	if exp, act := "Skipped: deploy", last.Output.Title; exp != act {
+		t.Errorf("Expected the deploy check run's title to be %q but got %q.", exp, act)
+	}
+}
+
+func TestPRComment(t *testing.T) {
+	t.Parallel()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tc := testcase{
+		env: []string{
+			"BUILD_MANIFEST=" + filepath.Join(wd, "testdata/waitfor.yaml"),
+			"_PR_NUMBER=7",
+			"_HEAD_BRANCH=feature",
+		},
+		containers: []testContainer{
+			{id: "c0", name: "step_0", start: 1 * ms},
+			{id: "c1", name: "step_1", start: 2 * ms, finish: 100 * ms, exit: 2, logs: []string{"=== RUN TestBuild", "\x1b[31mpanic: oops\x1b[0m"}},
+		},
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{ID: "c0", Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 2 * ms, Type: "container", Action: "start", Actor: dockerActor{ID: "c1", Attributes: dockerAttr{Name: "step_1"}}},
+			{TimeNano: 100 * ms, Type: "container", Action: "die", Actor: dockerActor{ID: "c1", Attributes: dockerAttr{Name: "step_1", ExitCode: "2"}}},
+		},
+	}
+	url := "https://console.cloud.google.com/cloud-build/builds;region=global/build-123"
+	running := "<!-- gcb2gh:gcb -->\n" +
+		"**gcb** is running on `feature`: [build-123](" + url + "?project=gcb-project)\n\n" +
+		"| Step | State | Duration | Exit code | Logs |\n" +
+		"| --- | --- | --- | --- | --- |\n" +
+		"| lint | Running | 0s |  | [logs](" + url + ";step=0?project=gcb-project) |\n" +
+		"| build | Running | 0s |  | [logs](" + url + ";step=1?project=gcb-project) |\n" +
+		"| test | Queued |  |  | [logs](" + url + ";step=2?project=gcb-project) |\n" +
+		"| deploy | Queued |  |  | [logs](" + url + ";step=3?project=gcb-project) |\n"
+	failed := "<!-- gcb2gh:gcb -->\n" +
+		"**gcb** failed on `feature`: [build-123](" + url + "?project=gcb-project)\n\n" +
+		"| Step | State | Duration | Exit code | Logs |\n" +
+		"| --- | --- | --- | --- | --- |\n" +
+		"| lint | Cancelled | 0s |  | [logs](" + url + ";step=0?project=gcb-project) |\n" +
+		"| build | Error | 0s | 2 | [logs](" + url + ";step=1?project=gcb-project) |\n" +
+		"| test | Skipped |  |  | [logs](" + url + ";step=2?project=gcb-project) |\n" +
+		"| deploy | Skipped |  |  | [logs](" + url + ";step=3?project=gcb-project) |\n" +
+		"\n### build\n\n```\n=== RUN TestBuild\npanic: oops\n```\n"
+
+	// The first build of the PR creates the comment, then edits it.
+	res := test(t, tc)
+	exp := []prComment{
+		{Method: "POST", Path: "/repos/unravelin/gcb2gh-test/issues/7/comments", Body: running},
+		{Method: "PATCH", Path: "/repos/unravelin/gcb2gh-test/issues/comments/100", Body: failed},
+	}
+	if diff := cmp.Diff(exp, res.comments); diff != "" {
+		t.Errorf("Expected PR comments (-) but got (+):\n%s", diff)
+	}
+
+	// Later builds edit the comment left by the first.
+	tc.prComments = []string{"LGTM", "<!-- gcb2gh:gcb -->\n**gcb** passed"}
+	res = test(t, tc)
+	exp = []prComment{
+		{Method: "PATCH", Path: "/repos/unravelin/gcb2gh-test/issues/comments/2", Body: running},
+		{Method: "PATCH", Path: "/repos/unravelin/gcb2gh-test/issues/comments/2", Body: failed},
+	}
+	if diff := cmp.Diff(exp, res.comments); diff != "" {
+		t.Errorf("Expected PR comments (-) but got (+):\n%s", diff)
+	}
+	if len(res.statuses) != 2 {
+		t.Errorf("Expected 2 commit statuses too but got %d.", len(res.statuses))
+	}
+}
+
+func TestDeployments(t *testing.T) {
+	t.Parallel()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := test(t, testcase{
+		env: []string{
+			"BUILD_MANIFEST=" + filepath.Join(wd, "testdata/deploy.yaml"),
+			"DEPLOY_ENVIRONMENTS=deploy-staging=staging,deploy-prod=production",
+		},
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 30 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0", ExitCode: "0"}}},
+			{TimeNano: 60 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1"}}},
+			{TimeNano: 120 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1", ExitCode: "0"}}},
+			{TimeNano: 180 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_2"}}},
+			{TimeNano: 240 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_2", ExitCode: "1"}}},
+		},
+	})
+	url := "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step="
+	exp := []deployment{
+		{Path: "/repos/unravelin/gcb2gh-test/deployments", Ref: "abc123", Task: "deploy", Environment: "staging", Payload: map[string]string{"build_id": "build-123"}, RequiredContexts: []string{}, Description: "deploy-staging"},
+		{Path: "/repos/unravelin/gcb2gh-test/deployments/1/statuses", State: "in_progress", LogURL: url + "1?project=gcb-project", Description: "deploy-staging: Running"},
+		{Path: "/repos/unravelin/gcb2gh-test/deployments/1/statuses", State: "success", LogURL: url + "1?project=gcb-project", Description: "deploy-staging: Done"},
+		{Path: "/repos/unravelin/gcb2gh-test/deployments", Ref: "abc123", Task: "deploy", Environment: "production", Payload: map[string]string{"build_id": "build-123"}, RequiredContexts: []string{}, Description: "deploy-prod"},
+		{Path: "/repos/unravelin/gcb2gh-test/deployments/2/statuses", State: "in_progress", LogURL: url + "2?project=gcb-project", Description: "deploy-prod: Running"},
+		{Path: "/repos/unravelin/gcb2gh-test/deployments/2/statuses", State: "failure", LogURL: url + "2?project=gcb-project", Description: "deploy-prod: Error"},
+	}
+	if diff := cmp.Diff(exp, res.deploys); diff != "" {
+		t.Errorf("Expected GitHub deployments (-) but got (+):\n%s", diff)
+	}
+	requireLogsContain(t, res.logs, "Build complete: error.")
+}
+
+func TestTemplates(t *testing.T) {
+	t.Parallel()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tc := testcase{
+		env: []string{
+			"BUILD_MANIFEST=" + filepath.Join(wd, "testdata/waitfor.yaml"),
+			`STATUS_DESCRIPTION_TEMPLATE={{index .Counts "Done"}}/{{len .Steps}} done{{with .Failed}}; {{.ID}} failed after {{duration .Duration}}: {{truncate 10 .LastLog}}{{end}}`,
+			`STATUS_URL_TEMPLATE={{with .Failed}}{{.URL}}{{else}}{{.Build.URL}}{{end}}&sha={{.Build.SHA}}`,
+			`CHECK_TITLE_TEMPLATE={{.Title}} [{{.Context}}]`,
+		},
+		containers: []testContainer{
+			{id: "c0", name: "step_0", start: 1 * ms},
+			{id: "c1", name: "step_1", start: 2 * ms, finish: 100 * ms, exit: 2, logs: []string{"=== RUN TestBuild", "panic: oops"}},
+		},
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{ID: "c0", Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 2 * ms, Type: "container", Action: "start", Actor: dockerActor{ID: "c1", Attributes: dockerAttr{Name: "step_1"}}},
+			{TimeNano: 100 * ms, Type: "container", Action: "die", Actor: dockerActor{ID: "c1", Attributes: dockerAttr{Name: "step_1", ExitCode: "2"}}},
+		},
+	}
+	url := "https://console.cloud.google.com/cloud-build/builds;region=global/build-123"
+
+	// Commit statuses.
+	res := test(t, tc)
+	exp := []commitStatus{
+		{Context: "gcb", State: "pending", Description: "0/4 done", TargetURL: url + "?project=gcb-project&sha=abc123"},
+		{Context: "gcb", State: "error", Description: "0/4 done; build failed after 0s: panic: ...", TargetURL: url + ";step=1?project=gcb-project&sha=abc123"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
+
+	// Check run titles.
+	tc.env = append(tc.env, "GITHUB_REPORTER=checks")
+	res = test(t, tc)
+	var titles []string
+	for _, run := range res.checkRuns {
+		titles = append(titles, run.Output.Title)
+	}
+	expTitles := []string{
+		"0 of 4 steps done [gcb]",
+		"0/4 done; build failed after 0s: panic: ... [gcb]",
+	}
+	if diff := cmp.Diff(expTitles, titles); diff != "" {
+		t.Errorf("Expected check run titles (-) but got (+):\n%s", diff)
+	}
+}
+
+func TestBadTemplate(t *testing.T) {
+	t.Parallel()
+
+	res := test(t, testcase{
+		fail: true,
+		env:  []string{"STATUS_DESCRIPTION_TEMPLATE={{.Steps"},
+	})
+	if res.err == nil {
+		t.Fatal("Expected error but received none.")
+	}
+	requireLogsContain(t, res.logs, "envvar STATUS_DESCRIPTION_TEMPLATE: ")
+}
+
+func TestLostCreates(t *testing.T) {
+	t.Parallel()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// GitHub creates the check run, but the response is lost. Rather than
+	// retrying and creating another, gcb2gh finds it before the next update.
+	res := test(t, testcase{
+		env:         []string{"GITHUB_REPORTER=checks"},
+		lostCreates: []int{http.StatusBadGateway},
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 100 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0", ExitCode: "1"}}},
+		},
+	})
+	var calls []string
+	for _, run := range res.checkRuns {
+		calls = append(calls, run.Method+" "+run.Path+" "+run.Status)
+	}
+	exp := []string{
+		"POST /repos/unravelin/gcb2gh-test/check-runs in_progress",
+		"PATCH /repos/unravelin/gcb2gh-test/check-runs/42 completed",
+	}
+	if diff := cmp.Diff(exp, calls); diff != "" {
+		t.Errorf("Expected GitHub check runs (-) but got (+):\n%s", diff)
+	}
+
+	// And the same for deployments.
+	res = test(t, testcase{
+		env: []string{
+			"BUILD_MANIFEST=" + filepath.Join(wd, "testdata/deploy.yaml"),
+			"DEPLOY_ENVIRONMENTS=deploy-staging=staging",
+		},
+		lostCreates: []int{http.StatusBadGateway},
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 5 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0", ExitCode: "0"}}},
+			{TimeNano: 10 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1"}}},
+			{TimeNano: 100 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1", ExitCode: "1"}}},
+		},
+	})
+	calls = nil
+	for _, d := range res.deploys {
+		calls = append(calls, d.Path+" "+d.Environment+d.State)
+	}
+	exp = []string{
+		"/repos/unravelin/gcb2gh-test/deployments staging",
+		"/repos/unravelin/gcb2gh-test/deployments/1/statuses failure",
+	}
+	if diff := cmp.Diff(exp, calls); diff != "" {
+		t.Errorf("Expected GitHub deployments (-) but got (+):\n%s", diff)
+	}
+}
+
+func TestAllowFailure(t *testing.T) {
+	t.Parallel()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := test(t, testcase{
+		env: []string{"BUILD_MANIFEST=" + filepath.Join(wd, "testdata/allowfailure.yaml")},
 		docker: []dockerEvent{
 			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 2 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1"}}},
+			{TimeNano: 3 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_2"}}},
+			{TimeNano: 50 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0", ExitCode: "1"}}},
+			{TimeNano: 60 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1", ExitCode: "2"}}},
+			{TimeNano: 150 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_2", ExitCode: "0"}}},
 		},
 	})
 	exp := []commitStatus{
-		{Context: "gcb-test", State: "pending", Description: "Running: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds/build-123;step=0?project=gcb-project"},
+		{Context: "gcb", State: "pending", Description: "Running: build, flaky, lint", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=2?project=gcb-project"},
+		{Context: "gcb", State: "pending", Description: "Running: build; Failed (allowed): flaky, lint", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=2?project=gcb-project"},
+		{Context: "gcb", State: "success", Description: "Failed (allowed): flaky, lint; Done: build", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=1?project=gcb-project"},
 	}
 	if diff := cmp.Diff(exp, res.statuses); diff != "" {
 		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
 	}
 }
 
-func TestGitHubShortToken(t *testing.T) {
-	test(t, testcase{
-		env: []string{"GITHUB_TOKEN=token"}, // As opposed to "user:pass".
+func TestKilledBySignal(t *testing.T) {
+	t.Parallel()
+	res := test(t, testcase{
 		docker: []dockerEvent{
 			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 5 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0", ExitCode: "139"}}},
 		},
 	})
+	exp := []commitStatus{
+		{Context: "gcb", State: "error", Description: "Killed: step_0 (SIGSEGV)", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
+	}
 }
 
-func TestBadGitHubRepo(t *testing.T) {
+func TestFailureLogs(t *testing.T) {
 	t.Parallel()
 	res := test(t, testcase{
-		fail: true,
-		env:  []string{"GITHUB_REPO=unknown"},
+		env: []string{"LOG_TAIL_LINES=2"},
+		containers: []testContainer{
+			{id: "c0", name: "step_0", start: 1 * ms, finish: 5 * ms, exit: 2, logs: []string{
+				"=== RUN TestEverything",
+				"\x1b[31mpanic: something went terribly wrong in a very long panic message, really long\x1b[0m",
+				"",
+			}},
+		},
 		docker: []dockerEvent{
-			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{ID: "c0", Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 5 * ms, Type: "container", Action: "die", Actor: dockerActor{ID: "c0", Attributes: dockerAttr{Name: "step_0", ExitCode: "2"}}},
 		},
 	})
-	if res.err == nil {
-		t.Fatal("Expected error but received none.")
+	exp := []commitStatus{
+		{Context: "gcb", State: "error", Description: `Error: step_0 "panic: something went terribly wrong in a very long panic..."`, TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
 	}
-	requireLogsContain(t, res.logs, `404 Not Found`)
 }
 
-func TestBadGitHubToken(t *testing.T) {
+func TestRecordReplay(t *testing.T) {
 	t.Parallel()
-	res := test(t, testcase{
-		fail: true,
-		env:  []string{"GITHUB_TOKEN=bad-token"},
+
+	// Record a build.
+	record := filepath.Join(t.TempDir(), "events.jsonl")
+	test(t, testcase{
+		env: []string{"DOCKER_EVENTS_RECORD=" + record},
 		docker: []dockerEvent{
 			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 5 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0", ExitCode: "0"}}},
+			{TimeNano: 50 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1"}}},
+			{TimeNano: 12_050 * ms, Type: "container", Action: "die", Actor: dockerActor{Attributes: dockerAttr{Name: "step_1", ExitCode: "1"}}},
 		},
 	})
-	if res.err == nil {
-		t.Fatal("Expected error but received none.")
+	b, err := os.ReadFile(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := 4, bytes.Count(b, []byte(`{"time":`)); exp != act {
+		t.Fatalf("Expected %d recorded events but got %d:\n%s", exp, act, b)
+	}
+
+	// The events are recorded at the times they arrived.
+	var times []time.Time
+	rd := json.NewDecoder(bytes.NewReader(b))
+	for rd.More() {
+		var rec struct {
+			Time time.Time `json:"time"`
+		}
+		if err := rd.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		times = append(times, rec.Time)
+	}
+	for i, exp := range []time.Duration{4 * time.Millisecond, 45 * time.Millisecond, 12 * time.Second} {
+		if act := times[i+1].Sub(times[i]); act < exp-200*time.Millisecond || act > exp+200*time.Millisecond {
+			t.Errorf("Expected recorded event %d to arrive %s after the last but got %s.", i+1, exp, act)
+		}
+	}
+
+	// Replay it, printing every update.
+	res := test(t, testcase{
+		env: []string{"DOCKER_EVENTS_FILE=" + record, "GITHUB_TOKEN="},
+	})
+	var printed []commitStatus
+	d := json.NewDecoder(&res.stdout)
+	for d.More() {
+		var s commitStatus
+		if err := d.Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		printed = append(printed, s)
+	}
+	exp := []commitStatus{
+		{Context: "gcb", State: "pending", Description: "Running: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+		{Context: "gcb", State: "success", Description: "Done: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=0?project=gcb-project"},
+		{Context: "gcb", State: "pending", Description: "Running: step_1; Done: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=1?project=gcb-project"},
+		{Context: "gcb", State: "error", Description: "Error: step_1 12s; Done: step_0", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=1?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, printed); diff != "" {
+		t.Errorf("Expected replayed updates (-) but got (+):\n%s", diff)
+	}
+	if len(res.statuses) != 0 {
+		t.Errorf("Expected replay not to update GitHub but got %d updates.", len(res.statuses))
 	}
-	requireLogsContain(t, res.logs, `Expected token "token" but got "bad-token".`)
 }
 
-func TestBadDockerHost(t *testing.T) {
+func TestStepStats(t *testing.T) {
 	t.Parallel()
 	res := test(t, testcase{
-		fail: true,
-		env:  []string{"DOCKER_HOST=unix:///dev/null"},
+		containers: []testContainer{
+			{id: "c0", name: "step_0", start: 1 * ms, finish: 100 * ms, mem: []int{1 << 20, 3 << 20, 2 << 20}},
+		},
 		docker: []dockerEvent{
-			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{ID: "c0", Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 100 * ms, Type: "container", Action: "die", Actor: dockerActor{ID: "c0", Attributes: dockerAttr{Name: "step_0", ExitCode: "0"}}},
 		},
 	})
-	if res.err == nil {
-		t.Fatal("Expected error but received none.")
+	requireLogsContain(t, res.logs, "Step report: step_0: Done 0s, peak memory 3.0MiB, average CPU 50.0%, network 1.0KiB in/2.0KiB out, block IO 4.0KiB read/0B written.")
+}
+
+func TestStepStatsSignalled(t *testing.T) {
+	t.Parallel()
+
+	// The step survives a SIGHUP, so its stats are collected until it exits.
+	res := test(t, testcase{
+		containers: []testContainer{
+			{id: "c0", name: "step_0", start: 1 * ms, finish: 100 * ms, mem: []int{1 << 20, 3 << 20, 2 << 20}},
+		},
+		docker: []dockerEvent{
+			{TimeNano: 1 * ms, Type: "container", Action: "start", Actor: dockerActor{ID: "c0", Attributes: dockerAttr{Name: "step_0"}}},
+			{TimeNano: 50 * ms, Type: "container", Action: "kill", Actor: dockerActor{ID: "c0", Attributes: dockerAttr{Name: "step_0", Signal: "1"}}},
+			{TimeNano: 100 * ms, Type: "container", Action: "die", Actor: dockerActor{ID: "c0", Attributes: dockerAttr{Name: "step_0", ExitCode: "0"}}},
+		},
+	})
+	requireLogsContain(t, res.logs, "Step report: step_0: Done 0s, peak memory 3.0MiB, average CPU 50.0%, network 1.0KiB in/2.0KiB out, block IO 4.0KiB read/0B written.")
+}
+
+func TestStartupContainers(t *testing.T) {
+	t.Parallel()
+	res := test(t, testcase{
+		containers: []testContainer{
+			{id: "c0", name: "step_0", start: -30_000 * ms, finish: -18_000 * ms},
+			{id: "c1", name: "step_1", start: -20_000 * ms, finish: 100 * ms},
+			{id: "sidecar", name: "postgres", start: -40_000 * ms},
+		},
+		docker: []dockerEvent{
+			{TimeNano: 100 * ms, Type: "container", Action: "die", Actor: dockerActor{ID: "c1", Attributes: dockerAttr{Name: "step_1", ExitCode: "0"}}},
+		},
+	})
+	exp := []commitStatus{
+		{Context: "gcb", State: "pending", Description: "Running: step_1 20s; Done: step_0 12s", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=1?project=gcb-project"},
+		{Context: "gcb", State: "success", Description: "Done: step_1 20s, step_0 12s", TargetURL: "https://console.cloud.google.com/cloud-build/builds;region=global/build-123;step=1?project=gcb-project"},
+	}
+	if diff := cmp.Diff(exp, res.statuses); diff != "" {
+		t.Errorf("Expected GitHub updates (-) but got (+):\n%s", diff)
 	}
-	requireLogsContain(t, res.logs, `dial unix /dev/null: connect: connection refused`)
 }
 
 type testcase struct {
 	fail   bool
 	env    []string
 	docker []dockerEvent
+	// disconnect drops the first docker events connection before sending
+	// the event with this index.
+	disconnect int
+	// idleDrop holds the second docker events connection open this long
+	// without sending any events, and then drops it.
+	idleDrop time.Duration
+	// dockerFails fails docker events connections after the first.
+	dockerFails bool
+	// containers already exist when gcb2gh starts.
+	containers []testContainer
+	// dockerTLS serves docker over TCP with TLS client certificates instead
+	// of a unix socket.
+	dockerTLS bool
+	// dockerTLSAnon serves docker over TCP with TLS to clients without
+	// certificates, which gcb2gh connects to with DOCKER_TLS and no home.
+	dockerTLSAnon bool
+	// holdOpen keeps the docker event stream open after the last event, as
+	// a real daemon would, rather than closing it.
+	holdOpen bool
+	// labels are the docker label filters gcb2gh is expected to use.
+	labels []string
+	// dockerLegacy fakes a docker daemon with API version 1.21, which
+	// doesn't support ping.
+	dockerLegacy bool
+	// ghErrors are the HTTP status codes the fake GitHub fails the first
+	// commit status requests with, with rate limit headers as appropriate.
+	ghErrors []int
+	// ghDelay slows down the fake GitHub's commit status responses.
+	ghDelay time.Duration
+	// lostCreates are the HTTP status codes the fake GitHub responds to the
+	// first requests creating check runs or deployments with, having
+	// created them anyway.
+	lostCreates []int
+	// appKey authenticates gcb2gh as GitHub App 123, rather than with a
+	// token.
+	appKey *rsa.PrivateKey
+	// prComments are the bodies of the comments already on pull request 7,
+	// with ids counting from 1.
+	prComments []string
+}
+
+// testContainer is a container known to the fake docker daemon. Its times are
+// relative to the daemon's first request, and it runs forever if finish is 0.
+type testContainer struct {
+	id, name string
+	exit     int
+	oom      bool
+	start    int64
+	finish   int64
+	logs     []string
+	// mem are the memory usage samples of the container's stats.
+	mem []int
+}
+
+// inspect returns c as the docker daemon would describe it at Unix nanoseconds
+// now, with its times relative to the Unix nanoseconds start.
+func (c testContainer) inspect(start, now int64) map[string]interface{} {
+	ts := func(ns int64) string {
+		return time.Unix(0, start+ns).UTC().Format(time.RFC3339Nano)
+	}
+	const zero = "0001-01-01T00:00:00Z"
+	state := map[string]interface{}{"Status": "created", "StartedAt": zero, "FinishedAt": zero}
+	switch {
+	case now < start+c.start:
+		// Not started.
+	case c.finish == 0 || now < start+c.finish:
+		state["Status"] = "running"
+		state["Running"] = true
+		state["StartedAt"] = ts(c.start)
+	default:
+		state["Status"] = "exited"
+		state["ExitCode"] = c.exit
+		state["OOMKilled"] = c.oom
+		state["StartedAt"] = ts(c.start)
+		state["FinishedAt"] = ts(c.finish)
+	}
+	return map[string]interface{}{"Id": c.id, "Name": "/" + c.name, "State": state}
 }
 
 type testres struct {
-	err      error
-	statuses []commitStatus
-	logs     bytes.Buffer
+	err       error
+	statuses  []commitStatus
+	checkRuns []checkRun
+	comments  []prComment
+	deploys   []deployment
+	// bearer counts the GitHub requests authorized with a bearer token.
+	bearer int
+	// appTokens counts the GitHub App installation tokens given out.
+	appTokens int
+	logs      bytes.Buffer
+	stdout    bytes.Buffer
 }
 
 func test(t *testing.T, tc testcase) (tr testres) {
@@ -179,10 +1415,52 @@ func test(t *testing.T, tc testcase) (tr testres) {
 		}
 	}()
 
-	// Create a fake GitHub API that logs updates.
+	// Create a fake GitHub API that logs updates. It takes the token as
+	// basic auth or as a bearer token.
 	var updLock sync.Mutex
 	var updates []commitStatus
+	var bearer, appTokens, ghFails int32
+	ghAuth := func(w http.ResponseWriter, r *http.Request) bool {
+		const expTok = "token"
+		_, tok, ok := r.BasicAuth()
+		if !ok {
+			tok, ok = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			atomic.AddInt32(&bearer, 1)
+		}
+		if !ok || tok != expTok {
+			http.Error(w, fmt.Sprintf("Expected token %q but got %q.", expTok, tok), http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
 	gmux := http.NewServeMux()
+
+	// Fake the GitHub App installation token exchange, checking the app's
+	// JWTs.
+	appJWT := func(w http.ResponseWriter, r *http.Request) bool {
+		jwt, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if err := verifyJWT(tc.appKey, jwt, "123"); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid app JWT: %s", err), http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+	gmux.HandleFunc("/repos/unravelin/gcb2gh-test/installation", func(w http.ResponseWriter, r *http.Request) {
+		if appJWT(w, r) {
+			fmt.Fprint(w, `{"id": 7}`)
+		}
+	})
+	gmux.HandleFunc("/app/installations/7/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, fmt.Sprintf("Expected a POST request but got %s.", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		if appJWT(w, r) {
+			atomic.AddInt32(&appTokens, 1)
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"token": "token", "expires_at": %q}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+		}
+	})
 	gmux.HandleFunc("/repos/unravelin/gcb2gh-test/statuses/abc123", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, fmt.Sprintf("Expected a POST request but got %s.", r.Method), http.StatusMethodNotAllowed)
@@ -190,9 +1468,24 @@ func test(t *testing.T, tc testcase) (tr testres) {
 		}
 
 		// Validate the token.
-		const expTok = "token"
-		if _, tok, ok := r.BasicAuth(); !ok || tok != expTok {
-			http.Error(w, fmt.Sprintf("Expected token %q but got %q.", expTok, tok), http.StatusUnauthorized)
+		if !ghAuth(w, r) {
+			return
+		}
+
+		// Be slow and fail as asked.
+		time.Sleep(tc.ghDelay)
+		if i := int(atomic.AddInt32(&ghFails, 1)) - 1; i < len(tc.ghErrors) {
+			switch code := tc.ghErrors[i]; code {
+			case http.StatusForbidden:
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, `{"message": "You have exceeded a secondary rate limit."}`, code)
+			case http.StatusTooManyRequests:
+				w.Header().Set("X-RateLimit-Remaining", "0")
+				w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Second).Unix(), 10))
+				http.Error(w, `{"message": "API rate limit exceeded."}`, code)
+			default:
+				http.Error(w, http.StatusText(code), code)
+			}
 			return
 		}
 
@@ -216,31 +1509,301 @@ func test(t *testing.T, tc testcase) (tr testres) {
 		updates = append(updates, upd)
 		updLock.Unlock()
 	})
+	// lostCreate responds to a request that created something with the next
+	// of tc.lostCreates, if any.
+	var lostCreates int32
+	lostCreate := func(w http.ResponseWriter) bool {
+		if i := int(atomic.AddInt32(&lostCreates, 1)) - 1; i < len(tc.lostCreates) {
+			http.Error(w, http.StatusText(tc.lostCreates[i]), tc.lostCreates[i])
+			return true
+		}
+		return false
+	}
+	var checkRuns []checkRun
+	checkRun := func(method string, status int, resp string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != method {
+				http.Error(w, fmt.Sprintf("Expected a %s request but got %s.", method, r.Method), http.StatusMethodNotAllowed)
+				return
+			}
+			if !ghAuth(w, r) {
+				return
+			}
+			run := checkRun{Method: r.Method, Path: r.URL.Path}
+			if err := json.NewDecoder(r.Body).Decode(&run); err != nil {
+				http.Error(w, fmt.Sprintf("Error decoding request: %s", err), http.StatusBadRequest)
+				return
+			}
+			updLock.Lock()
+			checkRuns = append(checkRuns, run)
+			updLock.Unlock()
+
+			if method == http.MethodPost && lostCreate(w) {
+				return
+			}
+			w.WriteHeader(status)
+			fmt.Fprint(w, resp)
+		}
+	}
+	gmux.HandleFunc("/repos/unravelin/gcb2gh-test/check-runs", checkRun(http.MethodPost, http.StatusCreated, `{"id": 42}`))
+	gmux.HandleFunc("/repos/unravelin/gcb2gh-test/check-runs/42", checkRun(http.MethodPatch, http.StatusOK, `{"id": 42}`))
+	gmux.HandleFunc("/repos/unravelin/gcb2gh-test/commits/abc123/check-runs", func(w http.ResponseWriter, r *http.Request) {
+		if !ghAuth(w, r) {
+			return
+		}
+		type found struct {
+			ID         int64  `json:"id"`
+			ExternalID string `json:"external_id"`
+		}
+		var runs struct {
+			CheckRuns []found `json:"check_runs"`
+		}
+		updLock.Lock()
+		for _, run := range checkRuns {
+			if run.Method == http.MethodPost && run.Name == r.URL.Query().Get("check_name") {
+				runs.CheckRuns = append(runs.CheckRuns, found{ID: 42, ExternalID: run.ExternalID})
+			}
+		}
+		updLock.Unlock()
+		json.NewEncoder(w).Encode(runs)
+	})
+	var comments []prComment
+	gmux.HandleFunc("/repos/unravelin/gcb2gh-test/issues/7/comments", func(w http.ResponseWriter, r *http.Request) {
+		if !ghAuth(w, r) {
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			var page []prComment
+			if r.URL.Query().Get("page") == "1" {
+				for i, body := range tc.prComments {
+					page = append(page, prComment{ID: int64(i + 1), Body: body})
+				}
+			}
+			json.NewEncoder(w).Encode(page)
+		case http.MethodPost:
+			c := prComment{Method: r.Method, Path: r.URL.Path}
+			if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+				http.Error(w, fmt.Sprintf("Error decoding request: %s", err), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"id": 100}`)
+
+			updLock.Lock()
+			comments = append(comments, c)
+			updLock.Unlock()
+		default:
+			http.Error(w, fmt.Sprintf("Expected a GET or POST request but got %s.", r.Method), http.StatusMethodNotAllowed)
+		}
+	})
+	gmux.HandleFunc("/repos/unravelin/gcb2gh-test/issues/comments/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch {
+			http.Error(w, fmt.Sprintf("Expected a PATCH request but got %s.", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		if !ghAuth(w, r) {
+			return
+		}
+		c := prComment{Method: r.Method, Path: r.URL.Path}
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			http.Error(w, fmt.Sprintf("Error decoding request: %s", err), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{}`)
+
+		updLock.Lock()
+		comments = append(comments, c)
+		updLock.Unlock()
+	})
+	var deploys []deployment
+	var deployIDs int32
+	deploy := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/deployments") {
+			// List the deployments created so far, numbered from 1.
+			type found struct {
+				ID          int64             `json:"id"`
+				Description string            `json:"description"`
+				Payload     map[string]string `json:"payload"`
+			}
+			q := r.URL.Query()
+			list := []found{}
+			var id int64
+			updLock.Lock()
+			for _, d := range deploys {
+				if d.Environment == "" {
+					continue
+				}
+				id++
+				if d.Ref == q.Get("sha") && d.Task == q.Get("task") && d.Environment == q.Get("environment") {
+					list = append(list, found{ID: id, Description: d.Description, Payload: d.Payload})
+				}
+			}
+			updLock.Unlock()
+			json.NewEncoder(w).Encode(list)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, fmt.Sprintf("Expected a POST request but got %s.", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		if !ghAuth(w, r) {
+			return
+		}
+		d := deployment{Path: r.URL.Path}
+		if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+			http.Error(w, fmt.Sprintf("Error decoding request: %s", err), http.StatusBadRequest)
+			return
+		}
+		updLock.Lock()
+		deploys = append(deploys, d)
+		updLock.Unlock()
+
+		if !strings.HasSuffix(r.URL.Path, "/deployments") {
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{}`)
+			return
+		}
+		id := atomic.AddInt32(&deployIDs, 1)
+		if lostCreate(w) {
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"id": %d}`, id)
+	}
+	gmux.HandleFunc("/repos/unravelin/gcb2gh-test/deployments", deploy)
+	gmux.HandleFunc("/repos/unravelin/gcb2gh-test/deployments/", deploy)
 	gh := httptest.NewServer(gmux)
 	defer gh.Close()
 
-	// Fake a Docker daemon to produce our test set of events.
+	// Fake a Docker daemon to produce our test set of events. Event times are
+	// relative to the first request, and reconnections only get the events
+	// since the time they ask for.
+	var dockerOnce sync.Once
+	var dockerStart int64
+	var dockerConns int32
 	dmux := http.NewServeMux()
+	dmux.HandleFunc("/_ping", func(w http.ResponseWriter, r *http.Request) {
+		if tc.dockerLegacy {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("API-Version", "1.41")
+		w.Write([]byte("OK"))
+	})
+	dmux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		v := "1.41"
+		if tc.dockerLegacy {
+			v = "1.21"
+		}
+		json.NewEncoder(w).Encode(map[string]string{"ApiVersion": v})
+	})
+	dmux.HandleFunc("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		dockerOnce.Do(func() { dockerStart = time.Now().UnixNano() })
+		if exp, act := "1", r.URL.Query().Get("all"); exp != act {
+			t.Errorf("Expected docker query param all=%q but got %q.", exp, act)
+		}
+		cs := []map[string]interface{}{}
+		for _, c := range tc.containers {
+			cs = append(cs, map[string]interface{}{"Id": c.id, "Names": []string{"/" + c.name}})
+		}
+		json.NewEncoder(w).Encode(cs)
+	})
+	dmux.HandleFunc("/containers/", func(w http.ResponseWriter, r *http.Request) {
+		id, endpoint, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/containers/"), "/")
+		for _, c := range tc.containers {
+			if c.id != id {
+				continue
+			}
+			switch endpoint {
+			case "json":
+				json.NewEncoder(w).Encode(c.inspect(dockerStart, time.Now().UnixNano()))
+			case "logs":
+				// Multiplex the logs alternately onto stdout and stderr.
+				tail, _ := strconv.Atoi(r.URL.Query().Get("tail"))
+				logs := c.logs
+				if len(logs) > tail {
+					logs = logs[len(logs)-tail:]
+				}
+				for n, line := range logs {
+					hdr := []byte{byte(1 + n%2), 0, 0, 0, 0, 0, 0, 0}
+					binary.BigEndian.PutUint32(hdr[4:], uint32(len(line)+1))
+					w.Write(hdr)
+					w.Write([]byte(line + "\n"))
+				}
+			case "stats":
+				// Stream a sample for each memory usage, using half a CPU.
+				w.Header().Set("Content-Type", "application/json")
+				for n, mem := range c.mem {
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"cpu_stats":    map[string]interface{}{"cpu_usage": map[string]int{"total_usage": (n + 1) * 500}, "system_cpu_usage": (n + 2) * 1000, "online_cpus": 1},
+						"precpu_stats": map[string]interface{}{"cpu_usage": map[string]int{"total_usage": n * 500}, "system_cpu_usage": (n + 1) * 1000, "online_cpus": 1},
+						"memory_stats": map[string]interface{}{"usage": mem + 1024, "stats": map[string]int{"inactive_file": 1024}},
+						"networks":     map[string]interface{}{"eth0": map[string]int{"rx_bytes": 1024, "tx_bytes": 2048}},
+						"blkio_stats":  map[string]interface{}{"io_service_bytes_recursive": []map[string]interface{}{{"op": "read", "value": 4096}}},
+					})
+				}
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+			default:
+				http.NotFound(w, r)
+			}
+			return
+		}
+		http.Error(w, "No such container: "+id, http.StatusNotFound)
+	})
 	dmux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		dockerOnce.Do(func() { dockerStart = time.Now().UnixNano() })
+		conn := atomic.AddInt32(&dockerConns, 1)
+
 		// Validate we've got the required filters.
 		q := r.URL.Query()
-		if exp, act := "10", q.Get("since"); exp != act {
-			t.Errorf("Expected docker query param since=%q but got %q.", exp, act)
+		since := q.Get("since")
+		if since == "" {
+			t.Errorf("Expected docker query param since on connection %d.", conn)
+		}
+		var filters map[string][]string
+		if err := json.Unmarshal([]byte(q.Get("filters")), &filters); err != nil {
+			t.Errorf("Error decoding docker query param filters=%q: %s", q.Get("filters"), err)
 		}
-		if exp, act := "container", q.Get("type"); exp != act {
-			t.Errorf("Expected docker query param since=%q but got %q.", exp, act)
+		expFilters := map[string][]string{
+			"type":  {"container"},
+			"event": {"start", "die", "kill", "oom"},
+		}
+		if tc.labels != nil {
+			expFilters["label"] = tc.labels
+		}
+		if diff := cmp.Diff(expFilters, filters); diff != "" {
+			t.Errorf("Expected docker event filters (-) but got (+):\n%s", diff)
+		}
+		sinceNano := parseDockerTime(t, since)
+		if conn > 1 && tc.dockerFails {
+			http.Error(w, "Docker is going away.", http.StatusInternalServerError)
+			return
+		}
+		if conn == 2 && tc.idleDrop > 0 {
+			w.(http.Flusher).Flush()
+			time.Sleep(tc.idleDrop)
+			return
 		}
 
 		// Send back the events.
 		w.Header().Set("Content-Type", "application/json")
 		s := json.NewEncoder(w)
-		now := time.Now().UnixNano()
-		ts := now
-		for _, e := range tc.docker {
-			// Sleep between events.
-			e.TimeNano += now
-			time.Sleep(time.Duration(e.TimeNano - ts))
-			ts = e.TimeNano
+		for n, e := range tc.docker {
+			e.TimeNano += dockerStart
+			if e.TimeNano < sinceNano {
+				continue
+			}
+
+			// Drop the first connection part way through an event.
+			if conn == 1 && tc.disconnect > 0 && n == tc.disconnect {
+				w.Write([]byte(`{"Type":"container","Act`))
+				return
+			}
+
+			// Sleep until the event.
+			time.Sleep(time.Until(time.Unix(0, e.TimeNano)))
 
 			// Send.
 			err := s.Encode(e)
@@ -250,28 +1813,46 @@ func test(t *testing.T, tc testcase) (tr testres) {
 			}
 			w.(http.Flusher).Flush()
 		}
+
+		// Keep the stream open like a real daemon.
+		if tc.holdOpen {
+			<-r.Context().Done()
+		}
 	})
-	dsock := filepath.Join(t.TempDir(), "docker.sock")
-	serveSocket(t, dsock, dmux)
+	dockerEnv := serveDocker(t, tc.dockerTLS, tc.dockerTLSAnon, versionedDocker(t, tc.dockerLegacy, dmux))
 
 	// Run gcb2gh.
 	run := exec.Command("go", "run", ".")
 	run.Stderr = &tr.logs
-	run.Stdout = os.Stdout
+	run.Stdout = &tr.stdout
 	run.Env = append(
 		os.Environ(),
 		"PROJECT_ID=gcb-project",
 		"BUILD_ID=build-123",
 		"COMMIT_SHA=abc123",
-		"DOCKER_HOST=unix://"+dsock,
 		"GITHUB_API="+gh.URL,
 		"GITHUB_TOKEN=user:token",
 		"GITHUB_USER=unravelin",
 		"GITHUB_REPO=gcb2gh-test",
+		"DOCKER_RECONNECT_TIMEOUT=500ms",
 	)
+	run.Env = append(run.Env, dockerEnv...)
+	if tc.appKey != nil {
+		keyFile := filepath.Join(t.TempDir(), "app.pem")
+		key := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(tc.appKey)})
+		if err := os.WriteFile(keyFile, key, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		run.Env = append(run.Env, "GITHUB_TOKEN=", "GITHUB_APP_ID=123", "GITHUB_APP_PRIVATE_KEY_FILE="+keyFile)
+	}
 	run.Env = append(run.Env, tc.env...)
 	tr.err = run.Run()
 	tr.statuses = updates
+	tr.checkRuns = checkRuns
+	tr.comments = comments
+	tr.deploys = deploys
+	tr.bearer = int(atomic.LoadInt32(&bearer))
+	tr.appTokens = int(atomic.LoadInt32(&appTokens))
 	return tr
 }
 
@@ -283,6 +1864,141 @@ func requireLogsContain(t *testing.T, logs bytes.Buffer, find string) {
 	}
 }
 
+// verifyJWT checks that jwt is a current RS256 JSON web token issued by iss
+// and signed by key.
+func verifyJWT(key *rsa.PrivateKey, jwt, iss string) error {
+	if key == nil {
+		return fmt.Errorf("not a GitHub App")
+	}
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("expected 3 parts but got %d", len(parts))
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], sig); err != nil {
+		return err
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+	var claims struct {
+		Iat int64  `json:"iat"`
+		Exp int64  `json:"exp"`
+		Iss string `json:"iss"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return err
+	}
+	if now := time.Now().Unix(); claims.Iss != iss || claims.Iat > now || claims.Exp < now {
+		return fmt.Errorf("unexpected claims %+v", claims)
+	}
+	return nil
+}
+
+// parseDockerTime parses the docker "since" timestamp s of the form
+// "seconds[.nanoseconds]" into Unix nanoseconds.
+func parseDockerTime(t *testing.T, s string) int64 {
+	sec, nsec, _ := strings.Cut(s, ".")
+	ts, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		t.Errorf("Parsing docker timestamp %q: %s", s, err)
+		return 0
+	}
+	ns, _ := strconv.ParseInt(nsec, 10, 64)
+	return ts*int64(time.Second) + ns
+}
+
+// versionedDocker wraps the fake docker daemon h to require requests be pinned
+// to the API version it reports, 1.41 or 1.21 if legacy.
+func versionedDocker(t *testing.T, legacy bool, h http.Handler) http.Handler {
+	exp := "/v1.41/"
+	if legacy {
+		exp = "/v1.21/"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/_ping" || r.URL.Path == "/version":
+			// Unversioned while negotiating.
+		case strings.HasPrefix(r.URL.Path, exp):
+			r.URL.Path = "/" + strings.TrimPrefix(r.URL.Path, exp)
+		default:
+			t.Errorf("Expected docker request path to start %q but got %q.", exp, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// serveDocker serves the fake docker daemon h and returns the envvars for
+// gcb2gh to connect to it: either a unix socket, or a TLS server requiring a
+// client certificate.
+func serveDocker(t *testing.T, useTLS, anon bool, h http.Handler) []string {
+	if anon {
+		d := httptest.NewTLSServer(h)
+		t.Cleanup(d.Close)
+
+		// Without a home, go run needs to be told where its caches are.
+		goEnv, err := exec.Command("go", "env", "GOCACHE", "GOMODCACHE", "GOPATH").Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs := strings.Split(strings.TrimSpace(string(goEnv)), "\n")
+		return []string{
+			"DOCKER_HOST=" + strings.Replace(d.URL, "https://", "tcp://", 1),
+			"DOCKER_TLS=1",
+			"HOME=",
+			"GOCACHE=" + dirs[0],
+			"GOMODCACHE=" + dirs[1],
+			"GOPATH=" + dirs[2],
+		}
+	}
+	if !useTLS {
+		dsock := filepath.Join(t.TempDir(), "docker.sock")
+		serveSocket(t, dsock, h)
+		return []string{"DOCKER_HOST=unix://" + dsock}
+	}
+
+	d := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "Expected a client certificate.", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	d.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	d.StartTLS()
+	t.Cleanup(d.Close)
+
+	// Write out the certificates as the docker CLI expects them, reusing the
+	// server's certificate as our client certificate.
+	certs := t.TempDir()
+	cert := d.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, block := range map[string]*pem.Block{
+		"ca.pem":   {Type: "CERTIFICATE", Bytes: d.Certificate().Raw},
+		"cert.pem": {Type: "CERTIFICATE", Bytes: cert.Certificate[0]},
+		"key.pem":  {Type: "PRIVATE KEY", Bytes: key},
+	} {
+		if err := os.WriteFile(filepath.Join(certs, file), pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return []string{
+		"DOCKER_HOST=" + strings.Replace(d.URL, "https://", "tcp://", 1),
+		"DOCKER_TLS_VERIFY=1",
+		"DOCKER_CERT_PATH=" + certs,
+	}
+}
+
 func serveSocket(t *testing.T, sockfile string, h http.Handler) {
 	sock, err := net.Listen("unix", sockfile)
 	if err != nil {
@@ -308,6 +2024,45 @@ type commitStatus struct {
 	Context     string `json:"context,omitempty"`
 }
 
+type checkRun struct {
+	Method      string         `json:"-"`
+	Path        string         `json:"-"`
+	Name        string         `json:"name,omitempty"`
+	HeadSHA     string         `json:"head_sha,omitempty"`
+	Status      string         `json:"status,omitempty"`
+	Conclusion  string         `json:"conclusion,omitempty"`
+	DetailsURL  string         `json:"details_url,omitempty"`
+	ExternalID  string         `json:"external_id,omitempty"`
+	CompletedAt string         `json:"completed_at,omitempty"`
+	Output      checkRunOutput `json:"output"`
+}
+
+// deployment is a request to create a deployment or to set its status.
+type deployment struct {
+	Path             string            `json:"-"`
+	Ref              string            `json:"ref,omitempty"`
+	Task             string            `json:"task,omitempty"`
+	Environment      string            `json:"environment,omitempty"`
+	Payload          map[string]string `json:"payload,omitempty"`
+	RequiredContexts []string          `json:"required_contexts,omitempty"`
+	State            string            `json:"state,omitempty"`
+	LogURL           string            `json:"log_url,omitempty"`
+	Description      string            `json:"description,omitempty"`
+}
+
+type prComment struct {
+	Method string `json:"-"`
+	Path   string `json:"-"`
+	ID     int64  `json:"id,omitempty"`
+	Body   string `json:"body"`
+}
+
+type checkRunOutput struct {
+	Title   string `json:"title"`
+	Summary string `json:"summary"`
+	Text    string `json:"text,omitempty"`
+}
+
 type dockerEvent struct {
 	Type     string      `json:"Type,omitempty"`
 	Action   string      `json:"Action,omitempty"`
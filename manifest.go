@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// manifest is what we know about the build from its google cloud build
+// manifest.
+type manifest struct {
+	// timeout is the build's timeout, or zero if unknown.
+	timeout time.Duration
+	steps   []manifestStep
+	// subs are the values of the build's substitutions.
+	subs map[string]string
+	// triggerID is the id of the build trigger that started the build, if
+	// it was read from the cloud build API.
+	triggerID string
+}
+
+// manifestStep is a build step from the manifest.
+type manifestStep struct {
+	// id is the explicit step id, or one derived from the step's image and
+	// args if it has none.
+	id string
+	// name is the step's container image.
+	name string
+	// waitFor are the numbers of the steps this step waits for before it
+	// starts.
+	waitFor []int
+	// timeout is the step's timeout, or zero if it has none.
+	timeout time.Duration
+	// allowFailure is whether the build carries on if the step fails.
+	allowFailure bool
+	// allowExitCodes are the nonzero exit codes the build carries on after.
+	allowExitCodes []int
+
+	// The gcb2gh options from the step's GCB2GH_* env entries.
+	//
+	// hide leaves the step out of the description, unless it fails.
+	hide bool
+	// context is the separate status context to report the step in, or
+	// empty for the main one.
+	context string
+	// label is the name to show for the step instead of its id, or empty.
+	label string
+	// optional is whether the step's failure doesn't fail the status.
+	optional bool
+	// runbook is a URL to link to when the step fails, instead of its logs.
+	runbook string
+}
+
+// ids returns the step ids, or their labels, indexed against the step number.
+func (m manifest) ids() map[int]string {
+	ids := make(map[int]string, len(m.steps))
+	for n, s := range m.steps {
+		ids[n] = s.id
+		if s.label != "" {
+			ids[n] = s.label
+		}
+	}
+	return ids
+}
+
+// step returns the manifest step n, or an empty one if it isn't in the
+// manifest.
+func (m manifest) step(n int) manifestStep {
+	if n < 0 || n >= len(m.steps) {
+		return manifestStep{}
+	}
+	return m.steps[n]
+}
+
+// allowed returns whether the build carries on after the failed step s, or
+// whether the step is optional to gcb2gh.
+func (m manifest) allowed(s gcbStep) bool {
+	ms := m.step(s.num)
+	if ms.allowFailure || ms.optional {
+		return true
+	}
+	for _, code := range ms.allowExitCodes {
+		if code == s.exit {
+			return true
+		}
+	}
+	return false
+}
+
+// waitingOn returns the numbers of the unfinished steps that step n is waiting
+// for, leaving out those that another of them is waiting for in turn.
+func (m manifest) waitingOn(steps map[int]gcbStep, n int) []int {
+	if n >= len(m.steps) {
+		return nil
+	}
+	var unfinished []int
+	for _, w := range m.steps[n].waitFor {
+		if !steps[w].status.finished() {
+			unfinished = append(unfinished, w)
+		}
+	}
+	var waiting []int
+	for _, w := range unfinished {
+		indirect := false
+		for _, u := range unfinished {
+			if u != w && m.dependsOn(u, w) {
+				indirect = true
+				break
+			}
+		}
+		if !indirect {
+			waiting = append(waiting, w)
+		}
+	}
+	return waiting
+}
+
+// dependsOn returns whether step n waits for step dep, directly or through
+// other steps.
+func (m manifest) dependsOn(n, dep int) bool {
+	seen := make(map[int]bool)
+	next := []int{n}
+	for len(next) > 0 {
+		n, next = next[0], next[1:]
+		for _, w := range m.steps[n].waitFor {
+			if w == dep {
+				return true
+			}
+			if !seen[w] {
+				seen[w] = true
+				next = append(next, w)
+			}
+		}
+	}
+	return false
+}
+
+// manifestConfig is the build configuration as written in a google cloud build
+// manifest, and as returned by the cloud build API.
+type manifestConfig struct {
+	Timeout       string               `json:"timeout" yaml:"timeout"`
+	Steps         []manifestStepConfig `json:"steps" yaml:"steps"`
+	Substitutions map[string]string    `json:"substitutions" yaml:"substitutions"`
+}
+
+// manifestStepConfig is a build step as written in the build configuration.
+type manifestStepConfig struct {
+	ID             string   `json:"id" yaml:"id"`
+	Name           string   `json:"name" yaml:"name"`
+	Entrypoint     string   `json:"entrypoint" yaml:"entrypoint"`
+	Args           []string `json:"args" yaml:"args"`
+	WaitFor        []string `json:"waitFor" yaml:"waitFor"`
+	Timeout        string   `json:"timeout" yaml:"timeout"`
+	AllowFailure   bool     `json:"allowFailure" yaml:"allowFailure"`
+	AllowExitCodes []int    `json:"allowExitCodes" yaml:"allowExitCodes"`
+	Env            []string `json:"env" yaml:"env"`
+}
+
+// readManifest parses the google cloud build manifest at mani, expanding the
+// substitutions in it from its defaults and the environment env. Returns an
+// empty manifest if any error occurs reading the file.
+func readManifest(mani string, env []string) manifest {
+	if mani == "" {
+		return manifest{}
+	}
+
+	// Read the build manifest.
+	b, err := os.ReadFile(mani)
+	if err != nil {
+		log.Printf("Opening build manifest: %s", err)
+		return manifest{}
+	}
+
+	// Parse the manifest steps, as JSON or YAML.
+	var c manifestConfig
+	if filepath.Ext(mani) == ".json" || bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		err = json.Unmarshal(b, &c)
+	} else {
+		err = yaml.Unmarshal(b, &c)
+	}
+	if err != nil {
+		log.Printf("Reading build manifest %q: %s", mani, err)
+		return manifest{}
+	}
+	return newManifest(mani, c, env)
+}
+
+// newManifest returns the manifest of the build configuration c read from
+// mani, expanding the substitutions in it from its defaults and the
+// environment env.
+func newManifest(mani string, c manifestConfig, env []string) manifest {
+	subs := substitutions(c.Substitutions, env)
+	m := manifest{
+		timeout: parseTimeout(mani, "build", expand(c.Timeout, subs)),
+		steps:   make([]manifestStep, len(c.Steps)),
+		subs:    subs,
+	}
+	nums := make(map[string]int, len(c.Steps))
+	taken := make(map[string]bool, len(c.Steps))
+	for n := range c.Steps {
+		c.Steps[n].ID = expand(c.Steps[n].ID, subs)
+		taken[c.Steps[n].ID] = true
+	}
+	for n, s := range c.Steps {
+		for i, w := range s.WaitFor {
+			s.WaitFor[i] = expand(w, subs)
+		}
+		id := s.ID
+		if id == "" {
+			var arg string
+			if len(s.Args) > 0 {
+				arg = expand(s.Args[0], subs)
+			}
+			id = fallbackID(taken, expand(s.Name, subs), expand(s.Entrypoint, subs), arg)
+		}
+		m.steps[n] = manifestStep{
+			id:      id,
+			name:    expand(s.Name, subs),
+			waitFor: waitFor(mani, nums, n, s.WaitFor),
+			timeout: parseTimeout(mani, "step "+id, expand(s.Timeout, subs)),
+
+			allowFailure:   s.AllowFailure,
+			allowExitCodes: s.AllowExitCodes,
+		}
+		stepOptions(mani, &m.steps[n], s.Env, subs)
+		if s.ID != "" {
+			nums[s.ID] = n
+		}
+	}
+	return m
+}
+
+// stepOptions sets the gcb2gh options of the step ms from the GCB2GH_* entries
+// of its env in the build manifest mani, expanding the substitutions subs.
+func stepOptions(mani string, ms *manifestStep, env []string, subs map[string]string) {
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(k, "GCB2GH_") {
+			continue
+		}
+		v = expand(v, subs)
+		switch k {
+		case "GCB2GH_HIDE":
+			ms.hide = parseBool(mani, ms.id, k, v)
+		case "GCB2GH_CONTEXT":
+			ms.context = v
+		case "GCB2GH_OPTIONAL":
+			ms.optional = parseBool(mani, ms.id, k, v)
+		case "GCB2GH_LABEL":
+			ms.label = v
+		case "GCB2GH_RUNBOOK":
+			ms.runbook = v
+		default:
+			log.Printf("Reading build manifest %q: step %s: unknown option %s", mani, ms.id, k)
+		}
+	}
+}
+
+// parseBool parses the boolean option k of step id from the build manifest
+// mani, such as "1" or "true". Returns false if v is invalid.
+func parseBool(mani, id, k, v string) bool {
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Reading build manifest %q: step %s: %s: %s", mani, id, k, err)
+		return false
+	}
+	return b
+}
+
+// fallbackID returns a step id for a step without one from its image name,
+// entrypoint and first arg, such as "go test" for gcr.io/cloud-builders/go
+// with the args "test ./...". Ids already taken get a numbered suffix, and the
+// new id is added to them.
+func fallbackID(taken map[string]bool, name, entrypoint, arg string) string {
+	id := entrypoint
+	if id == "" {
+		// Strip the image's registry, tag and digest.
+		id, _, _ = strings.Cut(path.Base(name), "@")
+		id, _, _ = strings.Cut(id, ":")
+	}
+	if f := strings.Fields(arg); len(f) > 0 {
+		id += " " + f[0]
+	}
+	id = strings.TrimSpace(id)
+	if id == "" {
+		id = "step"
+	}
+	unique := id
+	for i := 2; taken[unique]; i++ {
+		unique = id + " #" + strconv.Itoa(i)
+	}
+	taken[unique] = true
+	return unique
+}
+
+// waitFor resolves the waitFor ids of step n in the build manifest mani to
+// step numbers, given the numbers of the earlier steps' ids. As in GCB, a step
+// without waitFor waits for all of the steps before it, and "-" starts it
+// with the build.
+func waitFor(mani string, nums map[string]int, n int, ids []string) []int {
+	if len(ids) == 0 {
+		all := make([]int, n)
+		for w := range all {
+			all[w] = w
+		}
+		return all
+	}
+	var steps []int
+	for _, id := range ids {
+		if id == "-" {
+			return nil
+		}
+		w, ok := nums[id]
+		if !ok {
+			log.Printf("Reading build manifest %q: step %d waits for unknown step %q", mani, n, id)
+			continue
+		}
+		steps = append(steps, w)
+	}
+	return steps
+}
+
+// parseTimeout parses the timeout t of what from the build manifest mani, such
+// as "600s". Returns zero if t is empty or invalid.
+func parseTimeout(mani, what, t string) time.Duration {
+	if t == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(t)
+	if err != nil {
+		log.Printf("Reading build manifest %q: %s timeout: %s", mani, what, err)
+		return 0
+	}
+	return d
+}
+
+// builtinSubstitutions are the substitutions GCB provides to every build, which
+// we read from the environment.
+var builtinSubstitutions = []string{
+	"PROJECT_ID", "PROJECT_NUMBER", "BUILD_ID", "LOCATION", "TRIGGER_NAME",
+	"COMMIT_SHA", "REVISION_ID", "SHORT_SHA", "REPO_NAME", "REPO_FULL_NAME",
+	"BRANCH_NAME", "TAG_NAME", "REF_NAME", "TRIGGER_BUILD_CONFIG_PATH",
+	"SERVICE_ACCOUNT_EMAIL", "SERVICE_ACCOUNT",
+}
+
+// substitutions returns the values of the substitutions in a build: the
+// defaults from the manifest, overridden by the "_" user-defined and built-in
+// substitutions set in the environment env.
+func substitutions(defaults map[string]string, env []string) map[string]string {
+	subs := make(map[string]string, len(defaults)+len(builtinSubstitutions))
+	for k, v := range defaults {
+		subs[k] = v
+	}
+	builtin := make(map[string]bool, len(builtinSubstitutions))
+	for _, k := range builtinSubstitutions {
+		builtin[k] = true
+	}
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		if v != "" && (builtin[k] || strings.HasPrefix(k, "_")) {
+			subs[k] = v
+		}
+	}
+	if _, ok := subs["SHORT_SHA"]; !ok && len(subs["COMMIT_SHA"]) >= 7 {
+		subs["SHORT_SHA"] = subs["COMMIT_SHA"][:7]
+	}
+	return subs
+}
+
+// substitution matches an escaped "$$", "${VAR}" or "$VAR".
+var substitution = regexp.MustCompile(`\$\$|\$\{([A-Z_][A-Z0-9_]*)\}|\$([A-Z_][A-Z0-9_]*)`)
+
+// expand replaces the substitutions subs in s as GCB does, leaving any it
+// doesn't know as they are.
+func expand(s string, subs map[string]string) string {
+	return substitution.ReplaceAllStringFunc(s, func(m string) string {
+		if m == "$$" {
+			return "$"
+		}
+		k := strings.Trim(m, "${}")
+		if v, ok := subs[k]; ok {
+			return v
+		}
+		return m
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+)
+
+// ghUpdate is the desired GitHub state of a status context: its commit status,
+// or its check run if we report those instead. Updates to the build's pull
+// request comment and deployments use the same queue.
+type ghUpdate struct {
+	// context is the status context, or the deploy step's number.
+	context string
+	// final is whether this is the context's final state.
+	final   bool
+	status  ghStatusUpdate
+	check   *ghCheckRun
+	comment string
+	deploy  *ghDeploy
+}
+
+// same returns whether u would send GitHub the same state as v.
+func (u ghUpdate) same(v ghUpdate) bool {
+	if u.status != v.status || u.comment != v.comment || (u.check == nil) != (v.check == nil) || (u.deploy == nil) != (v.deploy == nil) {
+		return false
+	}
+	return (u.check == nil || *u.check == *v.check) && (u.deploy == nil || *u.deploy == *v.deploy)
+}
+
+// ghSender posts updates to GitHub in the background, so that a slow GitHub
+// doesn't hold up following the build. Only the latest update queued for each
+// status context is sent, and only if it differs from the last one GitHub
+// acknowledged.
+type ghSender struct {
+	post func(ghUpdate) error
+	wake chan struct{}
+	stop sync.Once
+
+	mu      sync.Mutex
+	idle    *sync.Cond
+	pending map[string]ghUpdate
+	posting bool
+	acked   map[string]ghUpdate
+	errs    map[string]error
+}
+
+// newGHSender starts sending updates to GitHub with post.
+func newGHSender(post func(ghUpdate) error) *ghSender {
+	s := &ghSender{
+		post:    post,
+		wake:    make(chan struct{}, 1),
+		pending: make(map[string]ghUpdate),
+		acked:   make(map[string]ghUpdate),
+		errs:    make(map[string]error),
+	}
+	s.idle = sync.NewCond(&s.mu)
+	go func() {
+		for range s.wake {
+			s.drain()
+		}
+	}()
+	return s
+}
+
+// send queues the update u, replacing any update for its context that hasn't
+// been sent yet.
+func (s *ghSender) send(u ghUpdate) {
+	s.mu.Lock()
+	s.pending[u.context] = u
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until all of the queued updates have been sent.
+func (s *ghSender) wait() {
+	s.mu.Lock()
+	for len(s.pending) > 0 || s.posting {
+		s.idle.Wait()
+	}
+	s.mu.Unlock()
+}
+
+// flush sends the queued updates and stops the sender. It returns an error if
+// the last update of any context couldn't be sent. Flushing again does
+// nothing more.
+func (s *ghSender) flush() error {
+	s.wait()
+	s.stop.Do(func() { close(s.wake) })
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	contexts := make([]string, 0, len(s.errs))
+	for c := range s.errs {
+		contexts = append(contexts, c)
+	}
+	sort.Strings(contexts)
+	if len(contexts) > 0 {
+		return s.errs[contexts[0]]
+	}
+	return nil
+}
+
+// drain sends the queued updates until there are none left, final updates
+// first.
+func (s *ghSender) drain() {
+	for {
+		s.mu.Lock()
+		if len(s.pending) == 0 {
+			s.posting = false
+			s.idle.Broadcast()
+			s.mu.Unlock()
+			return
+		}
+		batch := make([]ghUpdate, 0, len(s.pending))
+		for _, u := range s.pending {
+			batch = append(batch, u)
+		}
+		s.pending = make(map[string]ghUpdate)
+		s.posting = true
+		s.mu.Unlock()
+
+		sort.Slice(batch, func(i, j int) bool {
+			if batch[i].final != batch[j].final {
+				return batch[i].final
+			}
+			return batch[i].context < batch[j].context
+		})
+		for _, u := range batch {
+			s.mu.Lock()
+			last, ok := s.acked[u.context]
+			s.mu.Unlock()
+			if ok && last.same(u) {
+				continue
+			}
+
+			err := s.post(u)
+			s.mu.Lock()
+			if err != nil {
+				log.Print("Error: ", err)
+				s.errs[u.context] = err
+			} else {
+				log.Print("GH updated.")
+				s.acked[u.context] = u
+				delete(s.errs, u.context)
+			}
+			s.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stepStats are the resource usage statistics of a step container.
+type stepStats struct {
+	// samples is the number of stats samples taken.
+	samples int
+	// peakMem is the most memory used in bytes, excluding the page cache.
+	peakMem uint64
+	// cpuTotal is the sum of the CPU percentages sampled, for the average.
+	cpuTotal   float64
+	cpuSamples int
+	// netRx, netTx, blkRead and blkWrite are the total bytes of network and
+	// block IO.
+	netRx, netTx      uint64
+	blkRead, blkWrite uint64
+}
+
+// add adds the docker stats sample d to the statistics.
+func (s *stepStats) add(d dockerStats) {
+	s.samples++
+
+	// Memory, without the page cache as with the docker CLI.
+	mem := d.Memory.Usage
+	cache := d.Memory.Stats["inactive_file"]
+	if cache == 0 {
+		cache = d.Memory.Stats["cache"]
+	}
+	if cache < mem {
+		mem -= cache
+	}
+	if mem > s.peakMem {
+		s.peakMem = mem
+	}
+
+	// CPU percentage since the previous sample, where 100% is one CPU.
+	cpuDelta := float64(d.CPU.Usage.Total) - float64(d.PreCPU.Usage.Total)
+	sysDelta := float64(d.CPU.System) - float64(d.PreCPU.System)
+	if cpuDelta > 0 && sysDelta > 0 && d.PreCPU.System > 0 {
+		cpus := float64(d.CPU.OnlineCPUs)
+		if cpus == 0 {
+			cpus = float64(len(d.CPU.Usage.PerCPU))
+		}
+		s.cpuTotal += cpuDelta / sysDelta * cpus * 100
+		s.cpuSamples++
+	}
+
+	// IO counters are totals since the container started.
+	s.netRx, s.netTx = 0, 0
+	for _, n := range d.Networks {
+		s.netRx += n.RxBytes
+		s.netTx += n.TxBytes
+	}
+	s.blkRead, s.blkWrite = 0, 0
+	for _, b := range d.BlkIO.IOServiceBytes {
+		switch strings.ToLower(b.Op) {
+		case "read":
+			s.blkRead += b.Value
+		case "write":
+			s.blkWrite += b.Value
+		}
+	}
+}
+
+// avgCPU returns the average CPU percentage used, where 100% is one CPU.
+func (s stepStats) avgCPU() float64 {
+	if s.cpuSamples == 0 {
+		return 0
+	}
+	return s.cpuTotal / float64(s.cpuSamples)
+}
+
+func (s stepStats) String() string {
+	if s.samples == 0 {
+		return "no stats"
+	}
+	return fmt.Sprintf("peak memory %s, average CPU %.1f%%, network %s in/%s out, block IO %s read/%s written",
+		fmtBytes(s.peakMem), s.avgCPU(), fmtBytes(s.netRx), fmtBytes(s.netTx), fmtBytes(s.blkRead), fmtBytes(s.blkWrite))
+}
+
+// stats streams the resource usage statistics of the container with ID id,
+// calling fn with each sample until the stream or ctx ends.
+func (d *dockerClient) stats(ctx context.Context, id string, fn func(dockerStats)) error {
+	res, err := d.get(ctx, "/containers/"+url.PathEscape(id)+"/stats", url.Values{"stream": {"1"}})
+	if err != nil {
+		return fmt.Errorf("requesting docker container %s stats: %w", id, err)
+	}
+	defer res.Body.Close()
+
+	r := json.NewDecoder(res.Body)
+	for {
+		var s dockerStats
+		if err := r.Decode(&s); err != nil {
+			return fmt.Errorf("decoding docker container %s stats: %w", id, err)
+		}
+		fn(s)
+	}
+}
+
+// statsWatch collects the stats of a running container in the background.
+type statsWatch struct {
+	cancel func()
+	done   chan struct{}
+
+	mu    sync.Mutex
+	stats stepStats
+}
+
+// watchStats starts collecting the stats of the container with ID id until
+// stopStats is called or ctx ends.
+func (s *dockerStream) watchStats(ctx context.Context, id string) {
+	if s.docker == nil || id == "" || s.watches[id] != nil {
+		return
+	}
+	if s.watches == nil {
+		s.watches = make(map[string]*statsWatch)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	w := &statsWatch{cancel: cancel, done: make(chan struct{})}
+	s.watches[id] = w
+
+	go func() {
+		defer close(w.done)
+		err := s.docker.stats(ctx, id, func(d dockerStats) {
+			w.mu.Lock()
+			w.stats.add(d)
+			w.mu.Unlock()
+		})
+		if ctx.Err() == nil {
+			log.Printf("Error: %s", err)
+		}
+	}()
+}
+
+// stopStats stops collecting the stats of the container with ID id, returning
+// what was collected.
+func (s *dockerStream) stopStats(id string) stepStats {
+	w := s.watches[id]
+	if w == nil {
+		return stepStats{}
+	}
+	delete(s.watches, id)
+	w.cancel()
+	<-w.done
+	return w.stats
+}
+
+// logReport logs the final state and resource usage of each step.
+func logReport(steps map[int]gcbStep) {
+	st := make([]gcbStep, 0, len(steps))
+	for _, s := range steps {
+		st = append(st, s)
+	}
+	sort.Slice(st, func(i, j int) bool {
+		return st[i].num < st[j].num
+	})
+	for _, s := range st {
+		d := ""
+		if s.endNano != 0 {
+			d = " " + fmtDuration(time.Duration(s.endNano-s.startNano))
+		}
+		log.Printf("Step report: %s: %s%s, %s.", s.id, s.status, d, s.stats)
+	}
+}
+
+// fmtBytes returns the number of bytes b formatted with a binary unit.
+func fmtBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+type dockerStats struct {
+	Read     time.Time                     `json:"read"`
+	CPU      dockerCPUStats                `json:"cpu_stats"`
+	PreCPU   dockerCPUStats                `json:"precpu_stats"`
+	Memory   dockerMemoryStats             `json:"memory_stats"`
+	Networks map[string]dockerNetworkStats `json:"networks"`
+	BlkIO    dockerBlkIOStats              `json:"blkio_stats"`
+}
+
+type dockerCPUStats struct {
+	Usage struct {
+		Total  uint64   `json:"total_usage"`
+		PerCPU []uint64 `json:"percpu_usage"`
+	} `json:"cpu_usage"`
+	System     uint64 `json:"system_cpu_usage"`
+	OnlineCPUs uint32 `json:"online_cpus"`
+}
+
+type dockerMemoryStats struct {
+	Usage    uint64            `json:"usage"`
+	MaxUsage uint64            `json:"max_usage"`
+	Stats    map[string]uint64 `json:"stats"`
+	Limit    uint64            `json:"limit"`
+}
+
+type dockerNetworkStats struct {
+	RxBytes uint64 `json:"rx_bytes"`
+	TxBytes uint64 `json:"tx_bytes"`
+}
+
+type dockerBlkIOStats struct {
+	IOServiceBytes []struct {
+		Op    string `json:"op"`
+		Value uint64 `json:"value"`
+	} `json:"io_service_bytes_recursive"`
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// StatusView is the build as seen by the templates of commit status
+// descriptions, target URLs and check run titles, for a status context.
+type StatusView struct {
+	Build BuildView
+	// Context is the name of the status context.
+	Context string
+	// State is the commit state: "pending", "success" or "error".
+	State string
+	// Description, TargetURL and Title are what gcb2gh would have used
+	// without a template.
+	Description string
+	TargetURL   string
+	Title       string
+	// Steps are the context's steps in the order of the build, leaving out
+	// hidden steps unless they failed.
+	Steps []StepView
+	// Counts are the number of Steps in each state, such as "Running".
+	Counts map[string]int
+	// Done is the number of Steps that have finished.
+	Done int
+	// Failed is the first of Steps to fail, or nil.
+	Failed *StepView
+}
+
+// BuildView is the build's metadata.
+type BuildView struct {
+	Project string
+	Region  string
+	ID      string
+	SHA     string
+	Branch  string
+	PR      string
+	// URL is the build's page in the cloud console.
+	URL string
+	// TriggerID and TriggerName are the build trigger that started the
+	// build, if known.
+	TriggerID   string
+	TriggerName string
+}
+
+// StepView is a step of the build.
+type StepView struct {
+	Num int
+	ID  string
+	// State is the step's state, such as "Running" or "Timed out".
+	State string
+	// Started is whether the step has started, and Duration how long it
+	// has been running for or took.
+	Started  bool
+	Duration time.Duration
+	// Failed is whether the step failed the build, with ExitCode, and the
+	// Signal that killed it if any.
+	Failed   bool
+	ExitCode int
+	Signal   string
+	// Waiting are the ids of the steps that a queued step is waiting on.
+	Waiting []string
+	// LastLog is the last line logged by a failed step.
+	LastLog string
+	// URL is the step's logs in the cloud console, and Runbook the step's
+	// GCB2GH_RUNBOOK.
+	URL     string
+	Runbook string
+}
+
+// templateFuncs are the helper functions available to templates.
+var templateFuncs = template.FuncMap{
+	// duration formats a time.Duration as "1m30s".
+	"duration": fmtDuration,
+	// truncate shortens a string to at most n bytes, ending with "...".
+	"truncate": func(n int, s string) string {
+		if len(s) <= n {
+			return s
+		}
+		if n <= 3 {
+			return strings.ToValidUTF8(s[:n], "")
+		}
+		return strings.ToValidUTF8(s[:n-3], "") + "..."
+	},
+	// join joins strings with a separator, such as the ids of the steps
+	// that a step is waiting on.
+	"join": strings.Join,
+}
+
+// parseTemplate parses the template named after its envvar, or returns nil if
+// it's empty.
+func parseTemplate(envvar, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return template.New(envvar).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+}
+
+// newStatusView returns the view of the steps of the build reported in the
+// status context, or the main one if it's empty, whose commit status would be
+// gh, as of the Unix nanoseconds nowNano.
+func newStatusView(build buildContext, mani manifest, steps map[int]gcbStep, context string, gh ghStatusUpdate, nowNano int64) StatusView {
+	v := StatusView{
+		Build: BuildView{
+			Project:     build.Project,
+			Region:      build.Region,
+			ID:          build.ID,
+			SHA:         build.SHA,
+			Branch:      build.Branch,
+			PR:          build.PR,
+			URL:         buildURL(build),
+			TriggerID:   mani.triggerID,
+			TriggerName: mani.subs["TRIGGER_NAME"],
+		},
+		Context:     gh.Context,
+		State:       string(gh.State),
+		Description: gh.Description,
+		TargetURL:   gh.TargetURL,
+		Counts:      make(map[string]int),
+	}
+	var failedNano int64
+	for _, s := range stepsInOrder(contextSteps(mani, steps, context)) {
+		if mani.step(s.num).hide && !s.status.failed() {
+			continue
+		}
+		sv := StepView{
+			Num:     s.num,
+			ID:      s.id,
+			State:   s.status.String(),
+			Started: s.startNano != 0,
+			Failed:  s.status.failed(),
+			URL:     stepURL(build, s.num),
+			Runbook: mani.step(s.num).runbook,
+		}
+		if sv.Started {
+			e := s.endNano
+			if e == 0 {
+				e = nowNano
+			}
+			sv.Duration = time.Duration(e - s.startNano)
+		}
+		if sv.Failed {
+			sv.ExitCode = s.exit
+			sv.LastLog = lastLogLine(s.logs, 140)
+		}
+		if s.status == gcbStatusKilled {
+			sv.Signal = signalName(s.signal)
+		}
+		if s.status == gcbStatusQueued {
+			for _, w := range mani.waitingOn(steps, s.num) {
+				sv.Waiting = append(sv.Waiting, steps[w].id)
+			}
+		}
+		v.Steps = append(v.Steps, sv)
+		v.Counts[sv.State]++
+		if s.status.finished() {
+			v.Done++
+		}
+		if sv.Failed && (v.Failed == nil || s.endNano < failedNano) {
+			failed := sv
+			v.Failed, failedNano = &failed, s.endNano
+		}
+	}
+	return v
+}
+
+// render returns the template t rendered against the view v, or def if
+// there's no template or it fails.
+func render(t *template.Template, v StatusView, def string) string {
+	if t == nil {
+		return def
+	}
+	var sb strings.Builder
+	if err := t.Execute(&sb, v); err != nil {
+		log.Printf("Error rendering envvar %s: %s.", t.Name(), err)
+		return def
+	}
+	return sb.String()
+}